@@ -4,8 +4,10 @@ import (
 	_ "embed"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"sync"
 
 	"gopkg.in/yaml.v2"
@@ -14,6 +16,9 @@ import (
 var configMutex sync.RWMutex
 var proxyRestartChan = make(chan bool, 1)
 
+// configAPIAddr 是配置页面的监听地址。接口没有认证，可以读取和修改配置、启停入口、清除缓存，只监听本机
+const configAPIAddr = "127.0.0.1:8081"
+
 //go:embed static/index.html
 var embeddedIndexHTML []byte
 
@@ -22,7 +27,73 @@ func getConfigHandler(w http.ResponseWriter, r *http.Request) {
 	defer configMutex.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(config)
+	json.NewEncoder(w).Encode(redactSecrets(config))
+}
+
+// redactSecrets 返回去掉密码的配置副本，/api/config 不返回任何密码
+func redactSecrets(c Config) Config {
+	c.DefaultTarget.Password = ""
+	c.Users = redactUsers(c.Users)
+	c.Inbounds = append([]InboundConfig(nil), c.Inbounds...)
+	for i := range c.Inbounds {
+		c.Inbounds[i].Users = redactUsers(c.Inbounds[i].Users)
+	}
+	c.Proxies = append([]UpstreamConfig(nil), c.Proxies...)
+	for i := range c.Proxies {
+		c.Proxies[i].Password = ""
+	}
+	return c
+}
+
+func redactUsers(users []UserConfig) []UserConfig {
+	users = append([]UserConfig(nil), users...)
+	for i := range users {
+		users[i].Password = ""
+	}
+	return users
+}
+
+// restoreSecrets 把提交的配置中留空的密码换回原配置中的密码。页面拿到的配置不含密码，
+// 原样提交时不能把密码清掉；用户按用户名对应，入口和远端代理按名称对应，远端代理的用户名也相同时才保留
+func restoreSecrets(c *Config, old Config) {
+	if c.DefaultTarget.Password == "" && c.DefaultTarget.Username == old.DefaultTarget.Username {
+		c.DefaultTarget.Password = old.DefaultTarget.Password
+	}
+	restoreUserPasswords(c.Users, old.Users)
+	for i := range c.Inbounds {
+		for _, o := range old.Inbounds {
+			if o.Name == c.Inbounds[i].Name {
+				restoreUserPasswords(c.Inbounds[i].Users, o.Users)
+				break
+			}
+		}
+	}
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+		if p.Password != "" {
+			continue
+		}
+		for _, o := range old.Proxies {
+			if o.Name == p.Name && o.Username == p.Username {
+				p.Password = o.Password
+				break
+			}
+		}
+	}
+}
+
+func restoreUserPasswords(users, old []UserConfig) {
+	for i := range users {
+		if users[i].Password != "" {
+			continue
+		}
+		for _, o := range old {
+			if o.Username == users[i].Username {
+				users[i].Password = o.Password
+				break
+			}
+		}
+	}
 }
 
 func updateConfigHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,6 +105,7 @@ func updateConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 	configMutex.Lock()
 	oldConfig := config
+	restoreSecrets(&newConfig, oldConfig)
 	config = newConfig
 	configMutex.Unlock()
 
@@ -48,17 +120,18 @@ func updateConfigHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	InitChinaIPs()
-	if config.ChinaIps != "" {
-		loadIPRangesCached(config.ChinaIps)
-	}
-
-	oldAddr := getListenAddr(oldConfig)
-	newAddr := getListenAddr(config)
+	InitIPSets()
+	InitDomainSets()
+	InitGeoIPDB()
+	InitResolver()
+	InitUpstreams()
+	InitRules()
 
-	if newAddr != oldAddr || oldConfig.LocalMode != config.LocalMode || oldConfig.RemoteMode != config.RemoteMode {
-		go func() {
-			proxyRestartChan <- true
-		}()
+	// 入口的规则可能引用了新的远端代理，总是重新应用一次；只有地址或协议改变的入口会重启
+	go func() {
+		proxyRestartChan <- true
+	}()
+	if !reflect.DeepEqual(inboundConfigs(oldConfig), inboundConfigs(config)) {
 		w.Write([]byte("配置已更新，代理服务将自动重启生效"))
 		return
 	}
@@ -67,6 +140,93 @@ func updateConfigHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Configuration updated successfully")
 }
 
+// inboundsHandler 列出入口状态（GET），或启动/停止单个入口（POST ?name=xxx&action=start|stop）
+func inboundsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listInbounds())
+	case http.MethodPost:
+		name := r.URL.Query().Get("name")
+		var err error
+		switch r.URL.Query().Get("action") {
+		case "start":
+			c, ok := findInboundConfig(name)
+			if !ok {
+				http.Error(w, "Unknown inbound", http.StatusNotFound)
+				return
+			}
+			err = startInbound(c)
+		case "stop":
+			err = stopInbound(name)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		updateTrayForInbounds()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cacheHandler 列出远程数据源的缓存（GET），POST ?action=purge 删除缓存，可用 key=xxx 指定 key 或来源地址
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := listCaches()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		if r.URL.Query().Get("action") != "purge" {
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		n, err := purgeCaches(r.URL.Query().Get("key"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"removed": n})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ipSetsHandler 列出 IP 集合（GET），带 ?name=xxx&ip=x.x.x.x 时查询 IP 是否属于该集合
+func ipSetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		json.NewEncoder(w).Encode(listIPSets())
+		return
+	}
+	set := getIPSet(name)
+	if set == nil {
+		http.Error(w, "Unknown IP set", http.StatusNotFound)
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "Invalid IP", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"name": name, "ip": ip.String(), "contains": set.contains(ip)})
+}
+
 func startConfigWebServer() {
 	mux := http.NewServeMux()
 
@@ -81,13 +241,17 @@ func startConfigWebServer() {
 		}
 	})
 
+	mux.HandleFunc("/api/inbounds", inboundsHandler)
+	mux.HandleFunc("/api/ipsets", ipSetsHandler)
+	mux.HandleFunc("/api/cache", cacheHandler)
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.Write(embeddedIndexHTML)
 	})
 
 	log.Println("Config web interface is running at: http://localhost:8081")
-	if err := http.ListenAndServe(":8081", mux); err != nil {
+	if err := http.ListenAndServe(configAPIAddr, mux); err != nil {
 		log.Fatalf("Failed to start config server: %v", err)
 	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigAPIHidesPasswords(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.DefaultTarget.Username, config.DefaultTarget.Password = "bob", "hunter2"
+	config.Users = []UserConfig{{Username: "frank", Password: "letmein"}}
+	config.Inbounds = []InboundConfig{{Name: "lan", Users: []UserConfig{{Username: "grace", Password: "opensesame"}}}}
+	config.Proxies = []UpstreamConfig{
+		{Name: "office", Type: "socks5", Username: "alice", Password: "secret"},
+		{Name: "cloud", Type: "http", Username: "carol", Password: "s3cret"},
+	}
+
+	rec := httptest.NewRecorder()
+	getConfigHandler(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	for _, secret := range []string{"hunter2", "secret", "s3cret", "letmein", "opensesame"} {
+		if strings.Contains(rec.Body.String(), `"`+secret+`"`) {
+			t.Errorf("GET /api/config leaked password %q: %s", secret, rec.Body)
+		}
+	}
+	if config.Proxies[0].Password != "secret" {
+		t.Fatal("redacting the response modified the live config")
+	}
+
+	// 页面原样提交时保留密码；改了用户名或新写了密码时以提交的为准
+	submitted := redactSecrets(config)
+	submitted.Proxies[1].Username = "dave"
+	submitted.Proxies = append(submitted.Proxies, UpstreamConfig{Name: "new", Username: "erin", Password: "fresh"})
+	restoreSecrets(&submitted, config)
+	want := map[string]string{"office": "secret", "cloud": "", "new": "fresh"}
+	for _, p := range submitted.Proxies {
+		if p.Password != want[p.Name] {
+			t.Errorf("proxy %s password = %q, want %q", p.Name, p.Password, want[p.Name])
+		}
+	}
+	if submitted.Users[0].Password != "letmein" {
+		t.Errorf("user password = %q, want it kept", submitted.Users[0].Password)
+	}
+	if submitted.Inbounds[0].Users[0].Password != "opensesame" {
+		t.Errorf("inbound user password = %q, want it kept", submitted.Inbounds[0].Users[0].Password)
+	}
+	if submitted.DefaultTarget.Password != "hunter2" {
+		t.Errorf("default_target password = %q, want it kept", submitted.DefaultTarget.Password)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// UserConfig 定义本地代理的一个用户，SOCKS5 和 HTTP 监听共用同一张用户表
+type UserConfig struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// checkUser 在用户表中校验用户名和密码，密码使用常量时间比较
+func checkUser(users []UserConfig, username, password string) bool {
+	for _, u := range users {
+		if u.Username == username &&
+			subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProxyAuthorization 校验 HTTP 请求的 Proxy-Authorization（Basic），
+// 返回认证通过的用户名；入口没有用户表时总是通过
+func (in *inbound) checkProxyAuthorization(req *http.Request) (string, bool) {
+	if !in.authRequired() {
+		return "", true
+	}
+	scheme, encoded, found := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found || !in.checkUser(username, password) {
+		return "", false
+	}
+	return username, true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheRoot 是远程数据源的缓存目录，为空时使用配置目录下的 cache
+var cacheRoot string
+
+func cacheDir() string {
+	if cacheRoot != "" {
+		return cacheRoot
+	}
+	dir, err := appDir()
+	if err != nil {
+		log.Printf("⚠ %v, using ./cache", err)
+		return "cache"
+	}
+	return filepath.Join(dir, "cache")
+}
+
+// cacheKey 取数据源地址 SHA-256 的前 16 位十六进制，不同地址的缓存互不覆盖
+func cacheKey(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+// cachePath 返回数据源的缓存文件 <key>.data，元数据在同目录的 <key>.json
+func cachePath(source string) string {
+	return filepath.Join(cacheDir(), cacheKey(source)+".data")
+}
+
+func cacheMetaPath(source string) string {
+	return filepath.Join(cacheDir(), cacheKey(source)+".json")
+}
+
+// cacheMeta 记录缓存的来源和下载信息，ETag / Last-Modified 用于条件请求
+type cacheMeta struct {
+	Source       string    `json:"source"`        // 配置中的地址，缓存文件按它命名
+	URL          string    `json:"url,omitempty"` // 实际下载的地址，可能是镜像
+	FetchedAt    time.Time `json:"fetched_at"`    // 最近一次下载到新内容的时间
+	CheckedAt    time.Time `json:"checked_at"`    // 最近一次确认内容有效（包括 304）的时间
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Entries      int       `json:"entries"`
+}
+
+func readCacheMeta(source string) (cacheMeta, error) {
+	var meta cacheMeta
+	data, err := os.ReadFile(cacheMetaPath(source))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writeCacheMeta(source string, meta cacheMeta) {
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(cacheMetaPath(source), data, 0644); err != nil {
+		log.Printf("⚠ Failed to write cache metadata: %v", err)
+	}
+}
+
+// CacheInfo 是 /api/cache 和 cache list 返回的一个缓存
+type CacheInfo struct {
+	Key          string    `json:"key"`
+	Source       string    `json:"source"`
+	URL          string    `json:"url,omitempty"`
+	File         string    `json:"file"`
+	Size         int64     `json:"size"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	CheckedAt    time.Time `json:"checked_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Entries      int       `json:"entries"`
+}
+
+// listCaches 列出缓存目录中的所有缓存，按来源地址排序
+func listCaches() ([]CacheInfo, error) {
+	dir := cacheDir()
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []CacheInfo
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var meta cacheMeta
+		if json.Unmarshal(data, &meta) != nil {
+			continue
+		}
+		info := CacheInfo{
+			Key:          key,
+			Source:       meta.Source,
+			URL:          meta.URL,
+			File:         filepath.Join(dir, key+".data"),
+			FetchedAt:    meta.FetchedAt,
+			CheckedAt:    meta.CheckedAt,
+			ETag:         meta.ETag,
+			LastModified: meta.LastModified,
+			Entries:      meta.Entries,
+		}
+		if st, err := os.Stat(info.File); err == nil {
+			info.Size = st.Size()
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	return list, nil
+}
+
+// purgeCaches 删除 target 对应的缓存（key 或来源地址），target 为空时清空缓存目录。
+// 返回删除的缓存个数；已加载的集合不受影响，下次加载时重新下载
+func purgeCaches(target string) (int, error) {
+	dir := cacheDir()
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if isRemoteSource(target) {
+		target = cacheKey(target)
+	}
+	removed := make(map[string]bool)
+	var errs []string
+	for _, f := range files {
+		key, _, _ := strings.Cut(f.Name(), ".")
+		if f.IsDir() || (target != "" && key != target) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		removed[key] = true
+	}
+	if len(errs) > 0 {
+		return len(removed), fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return len(removed), nil
+}
+
+// runCacheCommand 处理命令行 "myproxy cache list" 和 "myproxy cache purge [key|地址]"，返回退出码
+func runCacheCommand(args []string) int {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := listCaches()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Cache directory: %s\n", cacheDir())
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tENTRIES\tSIZE\tFETCHED\tETAG\tSOURCE")
+		for _, c := range list {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", c.Key, c.Entries, c.Size,
+				c.FetchedAt.Local().Format("2006-01-02 15:04"), c.ETag, c.Source)
+		}
+		w.Flush()
+		return 0
+	case args[0] == "purge" && len(args) <= 2:
+		target := ""
+		if len(args) == 2 {
+			target = args[1]
+		}
+		n, err := purgeCaches(target)
+		fmt.Printf("Removed %d cache(s)\n", n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "usage: myproxy cache list | myproxy cache purge [key|url]")
+	return 2
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestCacheDir 把缓存目录换成临时目录
+func useTestCacheDir(t *testing.T) string {
+	saved := cacheRoot
+	cacheRoot = t.TempDir()
+	t.Cleanup(func() { cacheRoot = saved })
+	return cacheRoot
+}
+
+func TestFetchCachedPerSource(t *testing.T) {
+	dir := useTestCacheDir(t)
+	files := map[string][]byte{
+		"/a/cn.txt": []byte("1.0.0.0/8\n"),
+		"/b/cn.txt": []byte("2.0.0.0/8\n4.0.0.0/8\n"),
+	}
+	url := startStandInFileServer(t, files)
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+
+	// 两个同名文件的地址不能互相覆盖
+	a, err := fetchCached(url+"/a/cn.txt", defaultCacheMaxAge, FetchConfig{}, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fetchCached(url+"/b/cn.txt", defaultCacheMaxAge, FetchConfig{}, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b || filepath.Dir(a) != dir || filepath.Dir(b) != dir {
+		t.Fatalf("cache files %s and %s, want two files in %s", a, b, dir)
+	}
+	if data, _ := os.ReadFile(a); string(data) != "1.0.0.0/8\n" {
+		t.Errorf("cache for a = %q", data)
+	}
+
+	meta, err := readCacheMeta(url + "/b/cn.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Source != url+"/b/cn.txt" || meta.Entries != 2 || meta.FetchedAt.IsZero() {
+		t.Errorf("metadata = %+v", meta)
+	}
+}
+
+func TestListAndPurgeCaches(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "1.0.0.0/8\n", `"v1"`)
+	files := map[string][]byte{"/cn.txt": []byte("2.0.0.0/8\n")}
+	url := startStandInFileServer(t, files)
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+	for _, source := range []string{srv.url, url + "/cn.txt"} {
+		if _, err := fetchRemote(source, FetchConfig{}, validate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	cacheHandler(rec, httptest.NewRequest(http.MethodGet, "/api/cache", nil))
+	var list []CacheInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Fatalf("GET /api/cache = %s (%v)", rec.Body, err)
+	}
+	for _, c := range list {
+		if c.Key != cacheKey(c.Source) || c.Entries != 1 || c.Size == 0 {
+			t.Errorf("cache entry %+v", c)
+		}
+		if c.Source == srv.url && c.ETag != `"v1"` {
+			t.Errorf("ETag = %q, want \"v1\"", c.ETag)
+		}
+	}
+
+	// 按地址删除一个，再按 key 删除另一个
+	if n, err := purgeCaches(srv.url); err != nil || n != 1 {
+		t.Fatalf("purge by source: n=%d err=%v", n, err)
+	}
+	if _, err := os.Stat(cachePath(srv.url)); !os.IsNotExist(err) {
+		t.Error("purged cache file still exists")
+	}
+	if _, err := os.Stat(cachePath(url + "/cn.txt")); err != nil {
+		t.Error("purge removed another source's cache")
+	}
+	rec = httptest.NewRecorder()
+	cacheHandler(rec, httptest.NewRequest(http.MethodPost, "/api/cache?action=purge&key="+cacheKey(url+"/cn.txt"), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"removed\":1}\n" {
+		t.Fatalf("POST purge = %d %s", rec.Code, rec.Body)
+	}
+	if list, _ := listCaches(); len(list) != 0 {
+		t.Errorf("%d caches left after purge", len(list))
+	}
+
+	if code := runCacheCommand([]string{"purge"}); code != 0 {
+		t.Errorf("cache purge exit code %d", code)
+	}
+	if code := runCacheCommand([]string{"bogus"}); code != 2 {
+		t.Errorf("unknown subcommand exit code %d, want 2", code)
+	}
+}
@@ -14,30 +14,73 @@ import (
 type Config struct {
 	EnableWindowsProxy bool `yaml:"enable_windows_proxy" json:"enable_windows_proxy"`
 
+	// 旧的单个本地监听配置，inbounds 为空时作为名为 default 的入口使用
 	LocalMode  string `yaml:"local_mode" json:"local_mode"`
 	ListenOn   string `yaml:"listen_on" json:"listen_on"`
 	ListenPort int    `yaml:"listen_port" json:"listen_port"`
 
+	// 本地监听的用户表，非空时 SOCKS5 和 HTTP 代理都需要认证
+	Users []UserConfig `yaml:"users" json:"users"`
+
+	// 多个本地监听入口，每个入口可以覆盖 users 和 rules
+	Inbounds []InboundConfig `yaml:"inbounds" json:"inbounds"`
+
+	// 旧的单个远端代理配置，proxies 为空时作为名为 default 的代理使用
 	RemoteMode    string `yaml:"remote_mode" json:"remote_mode"`
 	DefaultTarget struct {
-		IP   string `yaml:"ip" json:"ip"`
-		Port int    `yaml:"port" json:"port"`
+		IP       string `yaml:"ip" json:"ip"`
+		Port     int    `yaml:"port" json:"port"`
+		Username string `yaml:"username,omitempty" json:"username,omitempty"`
+		Password string `yaml:"password,omitempty" json:"password,omitempty"`
 	} `yaml:"default_target" json:"default_target"`
 
+	// 具名的远端代理列表，第一个为默认代理，规则可以通过名称引用
+	Proxies []UpstreamConfig `yaml:"proxies" json:"proxies"`
+
 	ChinaIps      string `yaml:"china_ips" json:"china_ips"`
 	HeaderRewrite int    `yaml:"header_rewrite" json:"header_rewrite"` // 0=不改，1=全改，2=局域网不改
 	FakeIP        string `yaml:"fake_ip" json:"fake_ip"`               // 伪装的IP地址，默认31.13.77.33
+
+	// MMDB 国家数据库（本地路径或 URL），用于 "GEOIP,<国家代码>,ACTION" 规则
+	GeoIPDB string `yaml:"geoip_db,omitempty" json:"geoip_db,omitempty"`
+
+	// china_ips 和 geoip_db 为远程地址时的刷新间隔、下载内容的校验和下载方式
+	ChinaIpsSource SourceConfig `yaml:"china_ips_source,omitempty" json:"china_ips_source,omitempty"`
+	GeoIPDBSource  SourceConfig `yaml:"geoip_db_source,omitempty" json:"geoip_db_source,omitempty"`
+
+	// 具名 IP 集合，规则通过 "IP-SET,<name>,ACTION" 引用；cn（china_ips）和 lan 为内置集合
+	IPSets []IPSetConfig `yaml:"ip_sets,omitempty" json:"ip_sets,omitempty"`
+
+	// 具名域名集合（纯文本 / dnsmasq / geosite.dat），规则通过 "DOMAIN-SET,<name>,ACTION" 引用
+	DomainSets []DomainSetConfig `yaml:"domain_sets,omitempty" json:"domain_sets,omitempty"`
+
+	// 路由规则，按顺序匹配，例如 "DOMAIN-SUFFIX,google.com,PROXY"、"MATCH,DIRECT"、"DOMAIN,example.com,office"
+	Rules []string `yaml:"rules" json:"rules"`
+
+	// 仅 Linux：非 0 时给代理自身发出的连接设置 SO_MARK，透明代理规则据此排除它们，避免回环
+	RoutingMark int `yaml:"routing_mark,omitempty" json:"routing_mark,omitempty"`
+
+	// 路由判断和请求头改写使用的 DNS，servers 为空时使用系统解析
+	DNS DNSConfig `yaml:"dns" json:"dns"`
 }
 
 var config Config
 
+// appDir 返回配置目录 ~/myproxy
+func appDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("get home dir failed: %v", err)
+	}
+	return filepath.Join(home, "myproxy"), nil
+}
+
 // loadConfig 从用户目录下加载 YAML 配置文件，如果不存在则创建默认配置
 func loadConfig() error {
-	home, err := os.UserHomeDir()
+	configDir, err := appDir()
 	if err != nil {
-		return fmt.Errorf("get home dir failed: %v", err)
+		return err
 	}
-	configDir := filepath.Join(home, "myproxy")
 	configPath := filepath.Join(configDir, "config.yaml")
 
 	// 如果不存在，则创建默认配置文件
@@ -53,8 +96,10 @@ func loadConfig() error {
 			ListenPort:         1080,
 			RemoteMode:         "socks5",
 			DefaultTarget: struct {
-				IP   string `yaml:"ip" json:"ip"`
-				Port int    `yaml:"port" json:"port"`
+				IP       string `yaml:"ip" json:"ip"`
+				Port     int    `yaml:"port" json:"port"`
+				Username string `yaml:"username,omitempty" json:"username,omitempty"`
+				Password string `yaml:"password,omitempty" json:"password,omitempty"`
 			}{
 				IP:   "127.0.0.1",
 				Port: 12345,
@@ -120,8 +165,11 @@ func IsDirectTarget(host string) bool {
 		return isIPInRanges(ip)
 	}
 
-	// 如果是域名，则解析 DNS
-	ips, err := net.LookupIP(hostOnly)
+	// 如果是域名，则解析 DNS；不允许本地解析时交给代理
+	if !localResolveAllowed() {
+		return false
+	}
+	ips, err := lookupIP(hostOnly)
 	if err != nil {
 		log.Printf("DNS lookup failed for %s: %v", hostOnly, err)
 		return false
@@ -1,40 +1,182 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/url"
-
-	"golang.org/x/net/proxy"
+	"strings"
+	"time"
 )
 
-// getChainDialer 根据配置的远端模式生成 dialer
-func getChainDialer() (proxy.Dialer, error) {
-	addr := fmt.Sprintf("%s:%d", config.DefaultTarget.IP, config.DefaultTarget.Port)
-	if config.RemoteMode == "socks5" {
-		return proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
-	} else if config.RemoteMode == "http" {
-		proxyURL, err := url.Parse("http://" + addr)
-		if err != nil {
-			return nil, err
-		}
-		return proxy.FromURL(proxyURL, proxy.Direct)
+// errRejected 表示连接被 REJECT 规则拒绝
+var errRejected = errors.New("rejected by rule")
+
+// routeTarget 先按规则列表决定动作，未命中任何规则时回退到中国 IP 判断。
+// 返回 DIRECT、REJECT、PROXY（默认代理）或某个远端代理的名称
+func routeTarget(target string) string {
+	target = restoreFakeIP(target)
+	if action, ok := matchRules(target); ok {
+		return action
+	}
+	if IsDirectTarget(target) {
+		return ActionDirect
 	}
-	return nil, fmt.Errorf("unsupported remote_mode: %s", config.RemoteMode)
+	return ActionProxy
 }
 
 // dialTarget 根据目标地址判断是直连还是通过链式代理转发
 func dialTarget(target string) (net.Conn, error) {
 	//log.Printf("🎯 Direct target matched: %s", target)
-	if IsDirectTarget(target) {
+	return dialRoute(routeTarget(target), target)
+}
+
+// dialRoute 按 routeTarget 给出的动作建立连接
+func dialRoute(action, target string) (net.Conn, error) {
+	target = restoreFakeIP(target)
+	switch action {
+	case ActionReject:
+		log.Printf("dialTarget %s -> Reject", target)
+		return nil, fmt.Errorf("connection to %s %w", target, errRejected)
+	case ActionDirect:
 		log.Printf("dialTarget %s -> Direct", target)
-		return net.Dial("tcp", target)
+		return dialDirect(target)
 	}
-	dialer, err := getChainDialer()
+	dialer, err := getUpstreamDialer(action)
 	if err != nil {
 		return nil, err
 	}
-	//log.Printf("dialTarget %s -> Proxy", target)
+	//log.Printf("dialTarget %s -> Proxy(%s)", target, action)
 	return dialer.Dial("tcp", target)
 }
+
+// dialVia 为程序自身的请求（DNS 查询、下载列表等）建立 TCP 连接：via 为空或 DIRECT 时直连，
+// PROXY 使用默认的链式代理，其余为远端代理名称。timeout 只用于直连
+func dialVia(via, addr string, timeout time.Duration) (net.Conn, error) {
+	switch {
+	case via == "" || strings.EqualFold(via, ActionDirect):
+		return outboundDialer(timeout).Dial("tcp", addr)
+	case strings.EqualFold(via, ActionProxy):
+		dialer, err := getChainDialer()
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", addr)
+	}
+	dialer, err := getUpstreamDialer(via)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// dialDirect 直连目标，域名通过带缓存的解析器解析，与路由判断使用同一结果。
+// 同时有 IPv4 和 IPv6 地址时按 Happy Eyeballs 先连 IPv4，300ms 未成功（或 IPv4 全部失败）
+// 就开始尝试 IPv6，先连上的胜出，失效的 IPv6 地址不会拖慢连接
+func dialDirect(target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var primary, fallback []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			primary = append(primary, net.JoinHostPort(ip.String(), port))
+		} else {
+			fallback = append(fallback, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), directDialTimeout)
+	defer cancel()
+	if len(fallback) == 0 {
+		return dialSerial(ctx, primary)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	primaryFailed := make(chan struct{})
+	go func() {
+		conn, err := dialSerial(ctx, primary)
+		if err != nil {
+			close(primaryFailed)
+		}
+		results <- dialResult{conn, err}
+	}()
+	go func() {
+		timer := time.NewTimer(happyEyeballsDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-primaryFailed:
+		case <-ctx.Done():
+			results <- dialResult{nil, ctx.Err()}
+			return
+		}
+		conn, err := dialSerial(ctx, fallback)
+		results <- dialResult{conn, err}
+	}()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == nil {
+			if i == 0 {
+				// 另一组还在连接，取消后关掉它可能建立的连接
+				go func() {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}()
+			}
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialSerial 依次连接 addrs，剩余时间平均分给还没尝试的地址
+func dialSerial(ctx context.Context, addrs []string) (net.Conn, error) {
+	var lastErr error
+	for i, addr := range addrs {
+		dialCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok && i < len(addrs)-1 {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+			defer cancel()
+		}
+		conn, err := outboundDialer(0).DialContext(dialCtx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// outboundDialer 返回代理自身发起连接使用的 dialer，Linux 上按 routing_mark 给连接打标记
+func outboundDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: routingMarkControl}
+}
+
+const (
+	directDialTimeout  = 10 * time.Second       // 直连的总超时，多个地址时分摊
+	happyEyeballsDelay = 300 * time.Millisecond // IPv4 迟迟连不上时开始尝试 IPv6 的等待时间
+)
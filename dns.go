@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSConfig 定义路由和请求头改写共用的解析器
+type DNSConfig struct {
+	// 上游 DNS 服务器，例如 "udp://223.5.5.5:53"、"tcp://1.1.1.1"、"tls://1.1.1.1"、
+	// "https://dns.google/dns-query"，为空时使用系统解析
+	Servers []string `yaml:"servers" json:"servers"`
+	// TCP/DoT/DoH 查询经过的远端代理：为空或 DIRECT 时直连，PROXY 为默认代理
+	Via string `yaml:"via,omitempty" json:"via,omitempty"`
+	// 路由时何时在本地解析域名：lazy（默认，遇到 IP 类规则时才解析）或 never（从不解析，交给远端代理）
+	ResolveMode string `yaml:"resolve_mode,omitempty" json:"resolve_mode,omitempty"`
+
+	// DNS 服务器入口（protocol: dns）的分流上游：国内结果不在中国 IP 段内时改用国外结果
+	Domestic   []string `yaml:"domestic,omitempty" json:"domestic,omitempty"`       // 默认 223.5.5.5
+	Foreign    []string `yaml:"foreign,omitempty" json:"foreign,omitempty"`         // 默认 tcp://8.8.8.8
+	ForeignVia string   `yaml:"foreign_via,omitempty" json:"foreign_via,omitempty"` // 国外查询经过的代理，默认 PROXY
+
+	// fake-ip 模式：dns 入口对 A 查询返回该网段中的假 IP，连接到假 IP 时还原为域名再按规则路由
+	FakeIPRange  string   `yaml:"fake_ip_range,omitempty" json:"fake_ip_range,omitempty"`   // 例如 198.18.0.0/15，为空时不启用
+	FakeIPStore  string   `yaml:"fake_ip_store,omitempty" json:"fake_ip_store,omitempty"`   // 映射表文件，默认 ~/myproxy/cache_fakeip.json，相对路径相对于 ~/myproxy
+	FakeIPFilter []string `yaml:"fake_ip_filter,omitempty" json:"fake_ip_filter,omitempty"` // 不使用假 IP 的域名后缀
+
+	MinTTL int `yaml:"min_ttl,omitempty" json:"min_ttl,omitempty"` // 缓存时间下限（秒）
+	MaxTTL int `yaml:"max_ttl,omitempty" json:"max_ttl,omitempty"` // 缓存时间上限（秒）
+}
+
+const (
+	defaultDNSMinTTL = 10 * time.Second
+	defaultDNSMaxTTL = time.Hour
+	systemDNSTTL     = 60 * time.Second // 系统解析拿不到 TTL，使用固定值
+	negativeDNSTTL   = 30 * time.Second // 域名不存在时的缓存时间
+	dnsCacheLimit    = 4096
+)
+
+// 路由解析模式
+const (
+	resolveLazy  = "lazy"
+	resolveNever = "never"
+)
+
+// localResolveAllowed 判断路由判断时是否允许在本地解析域名。
+// never 模式下域名目标不会匹配 IP 类规则，也不做中国 IP 判断，直接交给远端代理解析
+func localResolveAllowed() bool {
+	return !strings.EqualFold(config.DNS.ResolveMode, resolveNever)
+}
+
+// timeNow 便于测试替换时钟
+var timeNow = time.Now
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsCall 是一次进行中的查询，同一域名的并发查询共用结果
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// resolver 带缓存的解析器，按 TTL 缓存结果，同一个域名在 TTL 内只解析一次
+type resolver struct {
+	upstreams []dnsUpstream
+	minTTL    time.Duration
+	maxTTL    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+	calls map[string]*dnsCall
+}
+
+var (
+	dnsResolver   = newResolver(nil, DNSConfig{})
+	resolverMutex sync.RWMutex
+)
+
+func newResolver(upstreams []dnsUpstream, cfg DNSConfig) *resolver {
+	r := &resolver{
+		upstreams: upstreams,
+		minTTL:    defaultDNSMinTTL,
+		maxTTL:    defaultDNSMaxTTL,
+		cache:     make(map[string]dnsCacheEntry),
+		calls:     make(map[string]*dnsCall),
+	}
+	if cfg.MinTTL > 0 {
+		r.minTTL = time.Duration(cfg.MinTTL) * time.Second
+	}
+	if cfg.MaxTTL > 0 {
+		r.maxTTL = time.Duration(cfg.MaxTTL) * time.Second
+	}
+	return r
+}
+
+// InitResolver 根据配置重建解析器，旧的缓存随之丢弃
+func InitResolver() {
+	var upstreams []dnsUpstream
+	for _, s := range config.DNS.Servers {
+		u, err := parseDNSUpstream(s, config.DNS.Via)
+		if err != nil {
+			log.Printf("Skipping invalid DNS server %q: %v", s, err)
+			continue
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	switch strings.ToLower(config.DNS.ResolveMode) {
+	case "", resolveLazy, resolveNever:
+	default:
+		log.Printf("Unknown DNS resolve_mode %q, using %s", config.DNS.ResolveMode, resolveLazy)
+	}
+
+	resolverMutex.Lock()
+	dnsResolver = newResolver(upstreams, config.DNS)
+	resolverMutex.Unlock()
+	initSplitDNS()
+	initFakeIP()
+	if len(upstreams) == 0 {
+		log.Println("✔ Using system DNS resolver with cache")
+	} else {
+		log.Printf("✔ Using %d DNS servers with cache", len(upstreams))
+	}
+}
+
+// lookupIP 是路由和请求头改写共用的解析入口
+func lookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolverMutex.RLock()
+	r := dnsResolver
+	resolverMutex.RUnlock()
+	return r.lookup(host)
+}
+
+func (r *resolver) lookup(host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	if e, ok := r.cache[host]; ok && timeNow().Before(e.expires) {
+		r.mu.Unlock()
+		return e.ips, e.err
+	}
+	if c, ok := r.calls[host]; ok {
+		r.mu.Unlock()
+		<-c.done
+		return c.ips, c.err
+	}
+	c := &dnsCall{done: make(chan struct{})}
+	r.calls[host] = c
+	r.mu.Unlock()
+
+	ips, ttl, err := r.query(host)
+	c.ips, c.err = ips, err
+
+	r.mu.Lock()
+	delete(r.calls, host)
+	r.store(host, ips, ttl, err)
+	r.mu.Unlock()
+	close(c.done)
+	return ips, err
+}
+
+// store 写入缓存，调用方持有 r.mu；只缓存成功结果和“域名不存在”
+func (r *resolver) store(host string, ips []net.IP, ttl time.Duration, err error) {
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return
+		}
+		ttl = negativeDNSTTL
+	} else {
+		ttl = max(r.minTTL, min(ttl, r.maxTTL))
+	}
+
+	if len(r.cache) >= dnsCacheLimit {
+		now := timeNow()
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= dnsCacheLimit {
+			r.cache = make(map[string]dnsCacheEntry)
+		}
+	}
+	r.cache[host] = dnsCacheEntry{ips: ips, err: err, expires: timeNow().Add(ttl)}
+}
+
+// query 向上游查询 A 和 AAAA 记录，返回地址和最小 TTL
+func (r *resolver) query(host string) ([]net.IP, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, systemDNSTTL, nil
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := r.queryType(host, qtype)
+			results <- result{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if len(res.ips) > 0 && (len(ips) == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, 0, firstErr
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// queryType 按顺序尝试各个上游，直到有一个返回有效响应
+func (r *resolver) queryType(host string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	msg, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, u := range r.upstreams {
+		resp, err := u.exchange(msg)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", u, err)
+			continue
+		}
+		ips, ttl, rcode, err := parseDNSAnswers(resp)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", u, err)
+			continue
+		}
+		switch rcode {
+		case dnsmessage.RCodeSuccess:
+			return ips, ttl, nil
+		case dnsmessage.RCodeNameError:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: u.String(), IsNotFound: true}
+		}
+		lastErr = fmt.Errorf("%s: %s", u, rcode)
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, IsTemporary: true}
+}
+
+// buildDNSQuery 构造一个开启递归的单问题查询
+func buildDNSQuery(host string, qtype dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseDNSAnswers 取出响应中的 A/AAAA 记录和其中最小的 TTL
+func parseDNSAnswers(resp []byte) ([]net.IP, uint32, dnsmessage.RCode, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		var ip net.IP
+		switch h.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			ip = net.IP(a.A[:])
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			ip = net.IP(aaaa.AAAA[:])
+		default:
+			// CNAME 等记录只跳过，最终地址会在同一个响应里给出
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+		if len(ips) == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+		ips = append(ips, ip)
+	}
+	return ips, ttl, header.RCode, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS 服务器入口的默认上游：国内直连查询，国外经默认代理用 TCP 查询
+var (
+	defaultDomesticDNS = []string{"udp://223.5.5.5:53"}
+	defaultForeignDNS  = []string{"tcp://8.8.8.8:53"}
+)
+
+// dnsTCPIdleTimeout 是 DNS over TCP 连接上两次查询之间的最长等待时间
+const dnsTCPIdleTimeout = 30 * time.Second
+
+// dnsUDPMinSize 是不带 EDNS0 的客户端能接收的最大 UDP 响应
+const dnsUDPMinSize = 512
+
+// splitDNS 同时向国内和国外上游查询：国内结果全部落在中国 IP 段内时采用国内结果，
+// 否则认为被污染或是国外域名，采用国外结果
+type splitDNS struct {
+	domestic []dnsUpstream
+	foreign  []dnsUpstream
+}
+
+var (
+	dnsSplit      = &splitDNS{}
+	dnsSplitMutex sync.RWMutex
+)
+
+// initSplitDNS 根据配置重建 DNS 服务器入口使用的上游
+func initSplitDNS() {
+	domestic, foreign := config.DNS.Domestic, config.DNS.Foreign
+	if len(domestic) == 0 {
+		domestic = defaultDomesticDNS
+	}
+	if len(foreign) == 0 {
+		foreign = defaultForeignDNS
+	}
+	via := config.DNS.ForeignVia
+	if via == "" {
+		via = ActionProxy
+	}
+
+	s := &splitDNS{
+		domestic: parseDNSUpstreams(domestic, ActionDirect),
+		foreign:  parseDNSUpstreams(foreign, via),
+	}
+	for i, u := range s.foreign {
+		// UDP 无法经过代理，直接查询会泄露国外域名，改用 TCP 经代理查询同一服务器
+		if udp, ok := u.(*udpDNSUpstream); ok && !strings.EqualFold(via, ActionDirect) {
+			log.Printf("Foreign DNS server %s uses UDP, querying it over TCP through %s instead", u, via)
+			s.foreign[i] = &tcpDNSUpstream{addr: udp.addr, via: via}
+		}
+	}
+	dnsSplitMutex.Lock()
+	dnsSplit = s
+	dnsSplitMutex.Unlock()
+}
+
+// parseDNSUpstreams 解析一组上游地址，跳过无效项
+func parseDNSUpstreams(servers []string, via string) []dnsUpstream {
+	var upstreams []dnsUpstream
+	for _, s := range servers {
+		u, err := parseDNSUpstream(s, via)
+		if err != nil {
+			log.Printf("Skipping invalid DNS server %q: %v", s, err)
+			continue
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+func currentSplitDNS() *splitDNS {
+	dnsSplitMutex.RLock()
+	defer dnsSplitMutex.RUnlock()
+	return dnsSplit
+}
+
+// exchange 转发一个查询并按分流策略选择响应
+func (s *splitDNS) exchange(msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	domesticCh := make(chan result, 1)
+	foreignCh := make(chan result, 1)
+	go func() {
+		resp, err := exchangeFirst(s.domestic, msg)
+		domesticCh <- result{resp, err}
+	}()
+	go func() {
+		resp, err := exchangeFirst(s.foreign, msg)
+		foreignCh <- result{resp, err}
+	}()
+
+	// 只有 A/AAAA 能用中国 IP 段校验，其他类型优先使用国外结果
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		if r := <-foreignCh; r.err == nil {
+			return r.resp, nil
+		}
+		r := <-domesticCh
+		return r.resp, r.err
+	}
+
+	dom := <-domesticCh
+	if dom.err == nil && answersInChina(dom.resp) {
+		return dom.resp, nil
+	}
+	foreign := <-foreignCh
+	if foreign.err == nil {
+		return foreign.resp, nil
+	}
+	// 国外查询失败时退回国内结果
+	if dom.err == nil {
+		log.Printf("Foreign DNS failed for %s, using domestic answer: %v", q.Name, foreign.err)
+		return dom.resp, nil
+	}
+	return nil, foreign.err
+}
+
+// exchangeFirst 按顺序尝试上游，返回第一个成功的响应
+func exchangeFirst(upstreams []dnsUpstream, msg []byte) ([]byte, error) {
+	lastErr := fmt.Errorf("no DNS server configured")
+	for _, u := range upstreams {
+		resp, err := u.exchange(msg)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("%s: %v", u, err)
+	}
+	return nil, lastErr
+}
+
+// answersInChina 判断响应是否成功且所有地址都在中国 IP 段（含局域网）内
+func answersInChina(resp []byte) bool {
+	ips, _, rcode, err := parseDNSAnswers(resp)
+	if err != nil || rcode != dnsmessage.RCodeSuccess || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !isIPInRanges(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// answerDNSQuery 处理客户端的一个查询，fake-ip 模式下优先返回假 IP，上游全部失败时返回 SERVFAIL
+func answerDNSQuery(msg []byte) []byte {
+	if resp := answerFakeIP(msg); resp != nil {
+		return resp
+	}
+	resp, err := currentSplitDNS().exchange(msg)
+	if err == nil {
+		return resp
+	}
+	log.Printf("DNS query failed: %v", err)
+	return dnsErrorReply(msg, dnsmessage.RCodeServerFailure)
+}
+
+// dnsErrorReply 根据查询构造一个只带问题部分的错误响应，查询无法解析时返回 nil
+func dnsErrorReply(msg []byte, rcode dnsmessage.RCode) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+// serveDNSUDP 在 UDP 上应答查询，每个查询单独处理
+func serveDNSUDP(pc net.PacketConn) {
+	b := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		msg := append([]byte(nil), b[:n]...)
+		go func() {
+			if resp := answerDNSQuery(msg); resp != nil {
+				pc.WriteTo(truncateDNSReply(msg, resp), from)
+			}
+		}()
+	}
+}
+
+// dnsUDPSize 返回客户端在 EDNS0 OPT 记录中声明的 UDP 缓冲区大小，不小于 512
+func dnsUDPSize(msg []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return dnsUDPMinSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsUDPMinSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsUDPMinSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(int(h.Class), dnsUDPMinSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsUDPMinSize
+		}
+	}
+}
+
+// truncateDNSReply 在响应超过客户端能接收的大小时只保留问题部分并设置 TC 位，
+// 让客户端改用 TCP 重新查询
+func truncateDNSReply(msg, resp []byte) []byte {
+	if len(resp) <= dnsUDPSize(msg) {
+		return resp
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return resp
+	}
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+	truncated, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return truncated
+}
+
+// serveDNSTCP 在 TCP 上应答查询，一个连接上可以连续发送多个查询
+func serveDNSTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Accept error:", err)
+			return
+		}
+		go handleDNSTCPConn(conn)
+	}
+}
+
+func handleDNSTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		resp := answerDNSQuery(msg)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)); err != nil {
+			return
+		}
+	}
+}
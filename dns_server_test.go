@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// useTestChinaRanges 把 cn 集合替换为给定网段并重建 lan 集合，测试结束后恢复
+func useTestChinaRanges(t *testing.T, cidrs ...string) {
+	t.Helper()
+	saved := ipSets.Load()
+	set, err := parseIPSet(ipSetChina, strings.NewReader(strings.Join(cidrs, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipSets.Store(&map[string]*ipSet{ipSetChina: set, ipSetLAN: newLANIPSet()})
+	t.Cleanup(func() { ipSets.Store(saved) })
+}
+
+// startTestDNSInbound 启动一个 dns 入口，返回监听地址
+func startTestDNSInbound(t *testing.T, domestic, foreign []string) string {
+	t.Helper()
+	config.DNS = DNSConfig{Domestic: domestic, Foreign: foreign, ForeignVia: ActionDirect}
+	InitResolver()
+	t.Cleanup(func() {
+		config.DNS = DNSConfig{}
+		InitResolver()
+	})
+
+	c := InboundConfig{Name: "test-dns", Protocol: "dns", Listen: "127.0.0.1", Port: 0}
+	if err := startInbound(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopInbound(c.Name) })
+	inboundsMutex.Lock()
+	defer inboundsMutex.Unlock()
+	return inbounds[c.Name].ln.Addr().String()
+}
+
+func queryA(t *testing.T, u dnsUpstream, host string) ([]net.IP, dnsmessage.RCode) {
+	t.Helper()
+	msg, err := buildDNSQuery(host, dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := u.exchange(msg)
+	if err != nil {
+		t.Fatalf("query %s via %s: %v", host, u, err)
+	}
+	ips, _, rcode, err := parseDNSAnswers(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ips, rcode
+}
+
+func TestDNSInboundSplitsByChinaRanges(t *testing.T) {
+	useTestChinaRanges(t, "1.2.0.0/16")
+	domestic := startStandInDNS(t, map[string][]net.IP{
+		"cn.test":       {net.ParseIP("1.2.3.4")},
+		"lan.test":      {net.ParseIP("192.168.1.10")},
+		"polluted.test": {net.ParseIP("8.8.8.8")},
+	})
+	foreign := startStandInDNS(t, map[string][]net.IP{
+		"cn.test":       {net.ParseIP("5.5.5.5")},
+		"polluted.test": {net.ParseIP("9.9.9.9")},
+	})
+	addr := startTestDNSInbound(t, []string{domestic.addr}, []string{"tcp://" + foreign.addr})
+
+	cases := []struct {
+		host string
+		want string
+	}{
+		{"cn.test", "1.2.3.4"},       // 国内结果在中国 IP 段内
+		{"lan.test", "192.168.1.10"}, // 局域网地址同样采用国内结果
+		{"polluted.test", "9.9.9.9"}, // 国内结果不在中国 IP 段内，改用国外结果
+	}
+	for _, u := range []dnsUpstream{&udpDNSUpstream{addr: addr}, &tcpDNSUpstream{addr: addr}} {
+		for _, c := range cases {
+			ips, rcode := queryA(t, u, c.host)
+			if rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || ips[0].String() != c.want {
+				t.Errorf("%s %s: got %v (%s), want %s", u, c.host, ips, rcode, c.want)
+			}
+		}
+	}
+}
+
+func TestDNSInboundFallbacks(t *testing.T) {
+	useTestChinaRanges(t)
+	domestic := startStandInDNS(t, map[string][]net.IP{"foreign.test": {net.ParseIP("8.8.8.8")}})
+
+	// 国外上游不可用时退回国内结果
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	addr := startTestDNSInbound(t, []string{domestic.addr}, []string{"tcp://" + deadAddr})
+
+	ips, rcode := queryA(t, &udpDNSUpstream{addr: addr}, "foreign.test")
+	if rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || ips[0].String() != "8.8.8.8" {
+		t.Fatalf("got %v (%s), want the domestic answer", ips, rcode)
+	}
+
+	// 所有上游都失败时返回 SERVFAIL
+	config.DNS.Domestic = []string{"tcp://" + deadAddr}
+	InitResolver()
+	if _, rcode := queryA(t, &tcpDNSUpstream{addr: addr}, "foreign.test"); rcode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("got %s, want SERVFAIL", rcode)
+	}
+}
+
+func TestForeignUDPServerQueriedOverTCPThroughProxy(t *testing.T) {
+	useTestChinaRanges(t)
+	domestic := startStandInDNS(t, map[string][]net.IP{"foreign.test": {net.ParseIP("6.6.6.6")}})
+	foreign := startStandInDNS(t, map[string][]net.IP{"foreign.test": {net.ParseIP("8.8.8.8")}})
+
+	stand := &standInHTTPProxy{}
+	upstreamSrv := httptest.NewServer(stand)
+	defer upstreamSrv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+	config.Proxies = []UpstreamConfig{{Name: "cloud", Type: "http", Server: host, Port: portNum}}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	addr := startTestDNSInbound(t, []string{domestic.addr}, []string{"udp://" + foreign.addr})
+	config.DNS.ForeignVia = "cloud"
+	InitResolver()
+
+	ips, rcode := queryA(t, &udpDNSUpstream{addr: addr}, "foreign.test")
+	if rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || ips[0].String() != "8.8.8.8" {
+		t.Fatalf("got %v (%s), want the foreign answer", ips, rcode)
+	}
+	if foreign.udpHits.Load() != 0 {
+		t.Error("foreign UDP server was queried directly")
+	}
+	if seen := stand.seen(false); len(seen) != 1 || seen[0] != "CONNECT "+foreign.addr {
+		t.Errorf("upstream proxy saw %v, want a CONNECT to %s", seen, foreign.addr)
+	}
+}
+
+func TestDNSInboundTruncatesLargeUDPReplies(t *testing.T) {
+	useTestChinaRanges(t)
+	var ips []net.IP
+	for i := 1; i <= 60; i++ {
+		ips = append(ips, net.IPv4(8, 8, 8, byte(i)))
+	}
+	domestic := startStandInDNS(t, nil)
+	foreign := startStandInDNS(t, map[string][]net.IP{"big.test": ips})
+	addr := startTestDNSInbound(t, []string{domestic.addr}, []string{"tcp://" + foreign.addr})
+
+	query := func(ednsSize uint16) dnsmessage.Header {
+		t.Helper()
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("big.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		if ednsSize > 0 {
+			b.StartAdditionals()
+			b.OPTResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Class: dnsmessage.Class(ednsSize)}, dnsmessage.OPTResource{})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 65535)
+		n, err := conn.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limit := max(int(ednsSize), dnsUDPMinSize)
+		if n > limit {
+			t.Fatalf("reply is %d bytes, want at most %d", n, limit)
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(resp[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	if h := query(0); !h.Truncated || h.ID != 7 {
+		t.Errorf("plain query: got %+v, want a truncated reply", h)
+	}
+	if h := query(4096); h.Truncated {
+		t.Error("EDNS0 query with a 4096-byte buffer was truncated")
+	}
+
+	// 收到 TC 的客户端改用 TCP 能拿到全部地址
+	got, _ := queryA(t, &tcpDNSUpstream{addr: addr}, "big.test")
+	if len(got) != len(ips) {
+		t.Errorf("TCP retry got %d addresses, want %d", len(got), len(ips))
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// standInDNS 是测试用的 DNS 服务器，同一端口上同时提供 UDP 和 TCP
+type standInDNS struct {
+	records  map[string][]net.IP // 域名（不带末尾点）-> 地址
+	ttl      uint32
+	truncate bool // UDP 响应总是设置 TC 位，迫使客户端改用 TCP
+	udpHits  atomic.Int32
+	tcpHits  atomic.Int32
+	addr     string
+}
+
+func startStandInDNS(t *testing.T, records map[string][]net.IP) *standInDNS {
+	t.Helper()
+	return newStandInDNS(records).start(t)
+}
+
+// newStandInDNS 创建尚未启动的服务器，ttl 和 truncate 要在 start 之前设置
+func newStandInDNS(records map[string][]net.IP) *standInDNS {
+	return &standInDNS{records: records, ttl: 300}
+}
+
+func (s *standInDNS) start(t *testing.T) *standInDNS {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("cannot listen on TCP %s: %v", pc.LocalAddr(), err)
+	}
+	s.addr = pc.LocalAddr().String()
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			s.udpHits.Add(1)
+			if resp := s.answer(b[:n], s.truncate); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				msg := make([]byte, int(length[0])<<8|int(length[1]))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				s.tcpHits.Add(1)
+				resp := s.answer(msg, false)
+				conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}()
+		}
+	}()
+	return s
+}
+
+// answer 按 records 生成响应，未知域名返回 NXDOMAIN
+func (s *standInDNS) answer(msg []byte, truncate bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := q.Name.String()
+	ips, known := s.records[name[:len(name)-1]]
+
+	rh := dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true, Truncated: truncate}
+	if !known {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rrh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			b.AResource(rrh, a)
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			b.AAAAResource(rrh, aaaa)
+		}
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+// useTestResolver 让全局解析器使用给定的服务器，并把时钟换成可控制的假时钟
+func useTestResolver(t *testing.T, servers ...string) *time.Time {
+	t.Helper()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	config.DNS = DNSConfig{Servers: servers}
+	InitResolver()
+	t.Cleanup(func() {
+		timeNow = time.Now
+		config.DNS = DNSConfig{}
+		InitResolver()
+	})
+	return &now
+}
+
+func TestLookupIPCachesUntilTTLExpires(t *testing.T) {
+	s := newStandInDNS(map[string][]net.IP{
+		"example.test": {net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")},
+	})
+	s.ttl = 60
+	s.start(t)
+	now := useTestResolver(t, "udp://"+s.addr)
+
+	ips, err := lookupIP("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("got %v, want both A and AAAA records", ips)
+	}
+	if got := s.udpHits.Load(); got != 2 {
+		t.Fatalf("got %d queries, want 2 (A and AAAA)", got)
+	}
+
+	// TTL 内再次查询应命中缓存，大小写和末尾点不影响
+	*now = now.Add(59 * time.Second)
+	if _, err := lookupIP("Example.Test."); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.udpHits.Load(); got != 2 {
+		t.Fatalf("got %d queries within TTL, want the cached result", got)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if _, err := lookupIP("example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.udpHits.Load(); got != 4 {
+		t.Fatalf("got %d queries after TTL expired, want 4", got)
+	}
+}
+
+func TestLookupIPNegativeCache(t *testing.T) {
+	s := startStandInDNS(t, map[string][]net.IP{})
+	now := useTestResolver(t, s.addr)
+
+	_, err := lookupIP("missing.test")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		t.Fatalf("got %v, want a not-found DNS error", err)
+	}
+	lookupIP("missing.test")
+	if got := s.udpHits.Load(); got != 2 {
+		t.Fatalf("got %d queries, want the NXDOMAIN answer cached", got)
+	}
+
+	*now = now.Add(negativeDNSTTL + time.Second)
+	lookupIP("missing.test")
+	if got := s.udpHits.Load(); got != 4 {
+		t.Fatalf("got %d queries after negative TTL, want 4", got)
+	}
+}
+
+func TestLookupIPFallsBackToTCPWhenTruncated(t *testing.T) {
+	s := newStandInDNS(map[string][]net.IP{"big.test": {net.ParseIP("5.6.7.8")}})
+	s.truncate = true
+	s.start(t)
+	useTestResolver(t, s.addr)
+
+	ips, err := lookupIP("big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("got %v, want [5.6.7.8]", ips)
+	}
+	if s.tcpHits.Load() == 0 {
+		t.Fatal("truncated UDP answer did not trigger a TCP retry")
+	}
+}
+
+func TestRulesUseConfiguredResolver(t *testing.T) {
+	s := startStandInDNS(t, map[string][]net.IP{"office.test": {net.ParseIP("10.1.2.3")}})
+	useTestResolver(t, "tcp://"+s.addr)
+
+	rules := compileRules([]string{"IP-CIDR,10.0.0.0/8,DIRECT", "MATCH,REJECT"})
+	if action, _ := matchRuleList(rules, "office.test:443"); action != ActionDirect {
+		t.Fatalf("got %s, want DIRECT via the configured resolver", action)
+	}
+	if s.udpHits.Load() != 0 || s.tcpHits.Load() == 0 {
+		t.Fatalf("udp=%d tcp=%d, want TCP-only queries", s.udpHits.Load(), s.tcpHits.Load())
+	}
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	cases := map[string]string{
+		"1.1.1.1":                      "udp://1.1.1.1:53",
+		"udp://8.8.8.8:5353":           "udp://8.8.8.8:5353",
+		"tcp://[2001:db8::1]":          "tcp://[2001:db8::1]:53",
+		"tls://1.1.1.1":                "tls://1.1.1.1:853",
+		"https://dns.google/dns-query": "https://dns.google/dns-query",
+	}
+	for in, want := range cases {
+		u, err := parseDNSUpstream(in, "")
+		if err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		if u.String() != want {
+			t.Errorf("%s: got %s, want %s", in, u, want)
+		}
+	}
+	if _, err := parseDNSUpstream("quic://1.1.1.1", ""); err == nil {
+		t.Error("unsupported scheme accepted")
+	}
+}
+
+// startStandInDoH 启动测试用的 DoH 服务器，返回查询地址
+func startStandInDoH(t *testing.T, s *standInDNS) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		msg, _ := io.ReadAll(req.Body)
+		s.tcpHits.Add(1)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(s.answer(msg, false))
+	}))
+	t.Cleanup(srv.Close)
+	trustTestCert(t, srv)
+	return srv.URL + "/dns-query"
+}
+
+// startStandInDoT 在 TLS 监听上提供 DNS 服务，证书与 httptest 的 TLS 服务器相同
+func startStandInDoT(t *testing.T, s *standInDNS) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	trustTestCert(t, srv)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				msg := make([]byte, int(length[0])<<8|int(length[1]))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				s.tcpHits.Add(1)
+				resp := s.answer(msg, false)
+				conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}()
+		}
+	}()
+	return "tls://" + ln.Addr().String()
+}
+
+// trustTestCert 让 DoT/DoH 客户端信任测试服务器的自签名证书
+func trustTestCert(t *testing.T, srv *httptest.Server) {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	dnsRootCAs = pool
+	t.Cleanup(func() { dnsRootCAs = nil })
+}
+
+func TestLookupIPOverDoH(t *testing.T) {
+	s := &standInDNS{records: map[string][]net.IP{"foreign.test": {net.ParseIP("8.8.4.4")}}, ttl: 300}
+	useTestResolver(t, startStandInDoH(t, s))
+
+	ips, err := lookupIP("foreign.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("8.8.4.4")) {
+		t.Fatalf("got %v, want [8.8.4.4]", ips)
+	}
+	if _, err := lookupIP("missing.test"); err == nil {
+		t.Fatal("NXDOMAIN over DoH resolved")
+	}
+}
+
+func TestLookupIPOverDoT(t *testing.T) {
+	s := &standInDNS{records: map[string][]net.IP{"foreign.test": {net.ParseIP("8.8.4.4")}}, ttl: 300}
+	useTestResolver(t, startStandInDoT(t, s))
+
+	ips, err := lookupIP("foreign.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("8.8.4.4")) {
+		t.Fatalf("got %v, want [8.8.4.4]", ips)
+	}
+	if got := s.tcpHits.Load(); got != 2 {
+		t.Fatalf("got %d DoT queries, want 2", got)
+	}
+}
+
+func TestDoTViaChainDialer(t *testing.T) {
+	s := &standInDNS{records: map[string][]net.IP{"foreign.test": {net.ParseIP("8.8.4.4")}}, ttl: 300}
+	dotURL := startStandInDoT(t, s)
+
+	stand := &standInHTTPProxy{}
+	upstreamSrv := httptest.NewServer(stand)
+	defer upstreamSrv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+	config.Proxies = []UpstreamConfig{{Name: "cloud", Type: "http", Server: host, Port: portNum}}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	// DoT 连接经默认代理建立，由代理去连 DNS 服务器
+	useTestResolver(t, dotURL)
+	config.DNS.Via = ActionProxy
+	InitResolver()
+
+	if _, err := lookupIP("foreign.test"); err != nil {
+		t.Fatal(err)
+	}
+	want := "CONNECT " + strings.TrimPrefix(dotURL, "tls://")
+	if seen := stand.seen(false); len(seen) == 0 || seen[0] != want {
+		t.Fatalf("upstream proxy saw %v, want %q", seen, want)
+	}
+}
+
+func TestDialDirectHappyEyeballs(t *testing.T) {
+	ln4, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln4.Close()
+	_, port, _ := net.SplitHostPort(ln4.Addr().String())
+	ln6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer ln6.Close()
+	_, port6, _ := net.SplitHostPort(ln6.Addr().String())
+
+	s := startStandInDNS(t, map[string][]net.IP{
+		// 不可达的 IPv6 地址排在前面，也不能拖慢 IPv4 连接
+		"dual.test": {net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")},
+		"v6.test":   {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	})
+	useTestResolver(t, s.addr)
+
+	start := time.Now()
+	conn, err := dialDirect(net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != ln4.Addr().String() || time.Since(start) > time.Second {
+		t.Errorf("connected to %s after %v, want IPv4 without waiting", conn.RemoteAddr(), time.Since(start))
+	}
+	conn.Close()
+
+	// IPv4 端口没有监听，立即改用 IPv6
+	start = time.Now()
+	conn, err = dialDirect(net.JoinHostPort("v6.test", port6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != ln6.Addr().String() || time.Since(start) > time.Second {
+		t.Errorf("connected to %s after %v, want the IPv6 fallback", conn.RemoteAddr(), time.Since(start))
+	}
+	conn.Close()
+}
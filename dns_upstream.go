@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dnsQueryTimeout 是单次向上游 DNS 查询的超时时间
+const dnsQueryTimeout = 5 * time.Second
+
+// dnsUpstream 是一个上游 DNS 服务器，收发的都是 DNS 报文的原始字节
+type dnsUpstream interface {
+	exchange(msg []byte) ([]byte, error)
+	String() string
+}
+
+// parseDNSUpstream 解析上游地址：
+//
+//	"udp://1.1.1.1:53"、"tcp://1.1.1.1"：不带协议时按 UDP 处理，不带端口时使用 53
+//	"tls://dns.google"：DNS-over-TLS，默认端口 853
+//	"https://dns.google/dns-query"：DNS-over-HTTPS (RFC 8484)
+//
+// via 指定 TCP/TLS/HTTPS 连接经过哪个远端代理，为空或 DIRECT 时直连；UDP 总是直连
+func parseDNSUpstream(s, via string) (dnsUpstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing DNS server address in %q", s)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "https" {
+		return newDoHUpstream(u.String(), via), nil
+	}
+
+	defaultPort := "53"
+	if scheme == "tls" {
+		defaultPort = "853"
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+	switch scheme {
+	case "udp":
+		return &udpDNSUpstream{addr: addr}, nil
+	case "tcp":
+		return &tcpDNSUpstream{addr: addr, via: via}, nil
+	case "tls":
+		return &dotDNSUpstream{addr: addr, serverName: u.Hostname(), via: via}, nil
+	}
+	return nil, fmt.Errorf("unsupported DNS server scheme: %s", u.Scheme)
+}
+
+// dnsRootCAs 用于校验 DoT/DoH 服务器证书，为 nil 时使用系统根证书
+var dnsRootCAs *x509.CertPool
+
+// dialDNS 建立到 DNS 服务器的流式连接，via 的含义见 dialVia
+func dialDNS(via, addr string) (net.Conn, error) {
+	return dialVia(via, addr, dnsQueryTimeout)
+}
+
+// udpDNSUpstream 使用 UDP 查询，响应被截断时改用 TCP 重试
+type udpDNSUpstream struct {
+	addr string
+}
+
+func (u *udpDNSUpstream) String() string { return "udp://" + u.addr }
+
+func (u *udpDNSUpstream) exchange(msg []byte) ([]byte, error) {
+	conn, err := outboundDialer(dnsQueryTimeout).Dial("udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 65535)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// 丢弃 ID 不匹配的响应
+		if n < 12 || b[0] != msg[0] || b[1] != msg[1] {
+			continue
+		}
+		if b[2]&0x02 != 0 { // TC 位
+			return (&tcpDNSUpstream{addr: u.addr}).exchange(msg)
+		}
+		return b[:n], nil
+	}
+}
+
+// tcpDNSUpstream 使用 TCP 查询，报文带 2 字节长度前缀
+type tcpDNSUpstream struct {
+	addr string
+	via  string
+}
+
+func (u *tcpDNSUpstream) String() string { return "tcp://" + u.addr }
+
+func (u *tcpDNSUpstream) exchange(msg []byte) ([]byte, error) {
+	conn, err := dialDNS(u.via, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	return exchangeDNSStream(conn, msg)
+}
+
+// dotDNSUpstream 使用 DNS-over-TLS 查询，每次查询一个连接
+type dotDNSUpstream struct {
+	addr       string
+	serverName string
+	via        string
+}
+
+func (u *dotDNSUpstream) String() string { return "tls://" + u.addr }
+
+func (u *dotDNSUpstream) exchange(msg []byte) ([]byte, error) {
+	raw, err := dialDNS(u.via, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: u.serverName, RootCAs: dnsRootCAs})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	return exchangeDNSStream(conn, msg)
+}
+
+// dohDNSUpstream 使用 DNS-over-HTTPS 查询（POST application/dns-message），连接可复用
+type dohDNSUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(rawURL, via string) *dohDNSUpstream {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialDNS(via, addr)
+		},
+		TLSClientConfig:     &tls.Config{RootCAs: dnsRootCAs},
+		TLSHandshakeTimeout: dnsQueryTimeout,
+		ForceAttemptHTTP2:   true,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &dohDNSUpstream{
+		url:    rawURL,
+		client: &http.Client{Transport: transport, Timeout: dnsQueryTimeout},
+	}
+}
+
+func (u *dohDNSUpstream) String() string { return u.url }
+
+func (u *dohDNSUpstream) exchange(msg []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 || body[0] != msg[0] || body[1] != msg[1] {
+		return nil, fmt.Errorf("malformed DNS response")
+	}
+	return body, nil
+}
+
+// exchangeDNSStream 在流式连接（TCP/TLS）上发送一个查询并读取响应
+func exchangeDNSStream(conn io.ReadWriter, msg []byte) ([]byte, error) {
+	req := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(req, uint16(len(msg)))
+	copy(req[2:], msg)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DomainSetConfig 定义一个具名域名集合，规则通过 "DOMAIN-SET,<name>,ACTION" 引用
+type DomainSetConfig struct {
+	Name        string           `yaml:"name" json:"name"`
+	Source      string           `yaml:"source" json:"source"`                       // 本地文件或 http(s) 地址
+	Format      string           `yaml:"format,omitempty" json:"format,omitempty"`   // plain（默认）/ dnsmasq / geosite
+	Code        string           `yaml:"code,omitempty" json:"code,omitempty"`       // geosite 分类，如 "cn"、"category-ads-all@ads"
+	Refresh     string           `yaml:"refresh,omitempty" json:"refresh,omitempty"` // 远程数据源的缓存有效期，默认 7 天
+	Verify      VerifyConfig     `yaml:"verify,omitempty" json:"verify,omitempty"`
+	FetchConfig `yaml:",inline"` // 远程数据源的 via、mirrors 等下载方式
+}
+
+const (
+	domainFormatPlain   = "plain"
+	domainFormatDnsmasq = "dnsmasq"
+	domainFormatGeosite = "geosite"
+)
+
+// domainTrie 是按域名标签从右到左组织的后缀树
+type domainTrie struct {
+	children map[string]*domainTrie
+	suffix   bool // 匹配该域名及其所有子域名
+	full     bool // 只匹配该域名本身
+}
+
+func (t *domainTrie) insert(domain string, full bool) {
+	node := t
+	for domain != "" {
+		i := strings.LastIndexByte(domain, '.')
+		label := domain[i+1:]
+		domain = domain[:max(i, 0)]
+		if node.children == nil {
+			node.children = make(map[string]*domainTrie)
+		}
+		child := node.children[label]
+		if child == nil {
+			child = &domainTrie{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	if full {
+		node.full = true
+	} else {
+		node.suffix = true
+	}
+}
+
+func (t *domainTrie) match(host string) bool {
+	node := t
+	for host != "" {
+		i := strings.LastIndexByte(host, '.')
+		label := host[i+1:]
+		host = host[:max(i, 0)]
+		if node = node.children[label]; node == nil {
+			return false
+		}
+		if node.suffix || host == "" && node.full {
+			return true
+		}
+	}
+	return false
+}
+
+// domainSet 是一个具名域名集合，后缀和完整域名放在后缀树中，关键字和正则逐个匹配
+type domainSet struct {
+	name     string
+	source   string
+	size     int
+	trie     domainTrie
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func normalizeDomain(d string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+}
+
+func (s *domainSet) addSuffix(d string) {
+	if d = normalizeDomain(d); d != "" {
+		s.trie.insert(d, false)
+		s.size++
+	}
+}
+
+func (s *domainSet) addFull(d string) {
+	if d = normalizeDomain(d); d != "" {
+		s.trie.insert(d, true)
+		s.size++
+	}
+}
+
+func (s *domainSet) addKeyword(k string) {
+	if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+		s.keywords = append(s.keywords, k)
+		s.size++
+	}
+}
+
+func (s *domainSet) addRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	s.regexps = append(s.regexps, re)
+	s.size++
+	return nil
+}
+
+// match 判断域名是否属于集合，host 需已转为小写并去掉末尾的点
+func (s *domainSet) match(host string) bool {
+	if s.trie.match(host) {
+		return true
+	}
+	for _, k := range s.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range s.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlainDomains 读取一行一个域名的列表，默认匹配域名及其子域名，
+// 支持 v2ray 风格的 full:、domain:、keyword:、regexp: 前缀，"+." 或 "." 开头的写法等同于后缀
+func parsePlainDomains(s *domainSet, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, found := strings.Cut(line, ":")
+		if !found {
+			s.addSuffix(strings.TrimPrefix(line, "+"))
+			continue
+		}
+		switch kind {
+		case "full":
+			s.addFull(value)
+		case "domain":
+			s.addSuffix(value)
+		case "keyword":
+			s.addKeyword(value)
+		case "regexp":
+			if err := s.addRegexp(value); err != nil {
+				log.Printf("Skipping invalid regexp %q in domain set %s: %v", value, s.name, err)
+			}
+		default:
+			log.Printf("Skipping invalid line %q in domain set %s", line, s.name)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDnsmasqDomains 读取 dnsmasq-china-list 格式的 "server=/example.com/114.114.114.114"，
+// 同一行可以有多个域名
+func parseDnsmasqDomains(s *domainSet, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, rest, found := strings.Cut(line, "=/")
+		if !found {
+			log.Printf("Skipping invalid line %q in domain set %s", line, s.name)
+			continue
+		}
+		parts := strings.Split(rest, "/")
+		for _, d := range parts[:len(parts)-1] { // 最后一段是服务器地址
+			s.addSuffix(d)
+		}
+	}
+	return scanner.Err()
+}
+
+// ------------------ geosite.dat ------------------
+
+// v2ray geosite.dat 是 protobuf 编码的 GeoSiteList：
+//
+//	GeoSiteList { repeated GeoSite entry = 1; }
+//	GeoSite     { string country_code = 1; repeated Domain domain = 2; }
+//	Domain      { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	Attribute   { string key = 1; ... }
+//
+// Type: 0=Plain（关键字）、1=Regex、2=Domain（后缀）、3=Full
+const (
+	geositePlain  = 0
+	geositeRegex  = 1
+	geositeDomain = 2
+	geositeFull   = 3
+)
+
+// protoField 是解码出的一个 protobuf 字段，varint 值放在 n 中，长度前缀的值放在 b 中
+type protoField struct {
+	num int
+	n   uint64
+	b   []byte
+}
+
+func readProtoVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid protobuf varint")
+}
+
+// walkProto 依次解码消息中的字段，不认识的定长字段被跳过
+func walkProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n, err := readProtoVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.n, n, err = readProtoVarint(b); err != nil {
+				return err
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return fmt.Errorf("truncated protobuf field")
+			}
+			b = b[size:]
+			continue
+		case 2:
+			l, n, err := readProtoVarint(b)
+			if err != nil {
+				return err
+			}
+			if uint64(len(b)-n) < l {
+				return fmt.Errorf("truncated protobuf field")
+			}
+			f.b = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseGeositeDomains 从 geosite.dat 中取出分类 code 的域名，"code@attr" 只取带该属性的域名
+func parseGeositeDomains(s *domainSet, data []byte, code string) error {
+	code, attr, _ := strings.Cut(strings.ToLower(code), "@")
+	if code == "" {
+		return fmt.Errorf("geosite format requires a code")
+	}
+	found := false
+	err := walkProto(data, func(entry protoField) error {
+		if entry.num != 1 || entry.b == nil {
+			return nil
+		}
+		var domains [][]byte
+		matched := false
+		err := walkProto(entry.b, func(f protoField) error {
+			switch f.num {
+			case 1:
+				matched = strings.EqualFold(string(f.b), code)
+			case 2:
+				domains = append(domains, f.b)
+			}
+			return nil
+		})
+		if err != nil || !matched {
+			return err
+		}
+		found = true
+		for _, d := range domains {
+			if err := addGeositeDomain(s, d, attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid geosite data: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("geosite code %q not found", code)
+	}
+	return nil
+}
+
+func addGeositeDomain(s *domainSet, b []byte, attr string) error {
+	var typ uint64
+	var value string
+	hasAttr := attr == ""
+	err := walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			typ = f.n
+		case 2:
+			value = string(f.b)
+		case 3:
+			return walkProto(f.b, func(a protoField) error {
+				if a.num == 1 && strings.EqualFold(string(a.b), attr) {
+					hasAttr = true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || !hasAttr {
+		return err
+	}
+	switch typ {
+	case geositePlain:
+		s.addKeyword(value)
+	case geositeRegex:
+		if err := s.addRegexp(value); err != nil {
+			log.Printf("Skipping invalid regexp %q in domain set %s: %v", value, s.name, err)
+		}
+	case geositeDomain:
+		s.addSuffix(value)
+	case geositeFull:
+		s.addFull(value)
+	}
+	return nil
+}
+
+// ------------------ 集合注册 ------------------
+
+// domainSets 和 ipSets 一样，更新时原子替换整张表
+var (
+	domainSets      atomic.Pointer[map[string]*domainSet]
+	domainSetsMutex sync.Mutex // 串行化更新
+	domainSetsGen   uint64     // 和 ipSetsGen 一样，丢弃被更晚的重建取代的结果
+)
+
+// parseDomainSet 按格式解析域名列表
+func parseDomainSet(c DomainSetConfig, data []byte) (*domainSet, error) {
+	s := &domainSet{name: c.Name, source: c.Source}
+	var err error
+	switch c.Format {
+	case "", domainFormatPlain:
+		err = parsePlainDomains(s, data)
+	case domainFormatDnsmasq:
+		err = parseDnsmasqDomains(s, data)
+	case domainFormatGeosite:
+		err = parseGeositeDomains(s, data, c.Code)
+	default:
+		err = fmt.Errorf("unknown domain list format %q", c.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadDomainSet 按配置加载一个域名集合，远程数据源和 IP 集合一样缓存到本地，同一地址的多个集合共用缓存
+func loadDomainSet(c DomainSetConfig) (*domainSet, error) {
+	maxAge, err := parseCacheMaxAge(c.Refresh)
+	if err != nil {
+		return nil, err
+	}
+	path, err := fetchCached(c.Source, maxAge, c.FetchConfig, domainSetValidator(c))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDomainSet(c, data)
+}
+
+// domainSetValidator 用集合自己的格式解析下载内容，统计域名条数
+func domainSetValidator(c DomainSetConfig) sourceValidator {
+	return newSourceValidator(c.Verify, func(body []byte) (int, error) {
+		s, err := parseDomainSet(c, body)
+		if err != nil {
+			return 0, err
+		}
+		return s.size, nil
+	})
+}
+
+// setDomainSet 加入或替换一个集合
+func setDomainSet(s *domainSet) {
+	domainSetsMutex.Lock()
+	defer domainSetsMutex.Unlock()
+	m := make(map[string]*domainSet)
+	if old := domainSets.Load(); old != nil {
+		maps.Copy(m, *old)
+	}
+	m[s.name] = s
+	domainSets.Store(&m)
+}
+
+func getDomainSet(name string) *domainSet {
+	if m := domainSets.Load(); m != nil {
+		return (*m)[name]
+	}
+	return nil
+}
+
+// domainSetMatch 判断域名是否属于指定集合，集合不存在时返回 false
+func domainSetMatch(name, host string) bool {
+	s := getDomainSet(name)
+	return s != nil && s.match(host)
+}
+
+// isDomainSetName 判断名称是否为已配置的域名集合
+func isDomainSetName(name string) bool {
+	for _, c := range config.DomainSets {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InitDomainSets 加载 domain_sets 中的集合，加载失败的集合保留上一次的内容
+func InitDomainSets() {
+	configMutex.RLock()
+	configs := config.DomainSets
+	configMutex.RUnlock()
+
+	// 和 InitIPSets 一样，下载不持锁，只在替换时持锁
+	domainSetsMutex.Lock()
+	domainSetsGen++
+	gen := domainSetsGen
+	domainSetsMutex.Unlock()
+
+	loaded := make(map[string]*domainSet)
+	for _, c := range configs {
+		if c.Name == "" || c.Source == "" {
+			log.Printf("Skipping domain set without name or source %q", c.Name)
+			continue
+		}
+		s, err := loadDomainSet(c)
+		if err != nil {
+			log.Printf("❌ Failed to load domain set %s: %v", c.Name, err)
+			if old := getDomainSet(c.Name); old != nil {
+				loaded[c.Name] = old
+			}
+			continue
+		}
+		loaded[c.Name] = s
+		log.Printf("✔ Loaded domain set %s (%d domains)", c.Name, s.size)
+	}
+
+	domainSetsMutex.Lock()
+	defer domainSetsMutex.Unlock()
+	if gen != domainSetsGen {
+		return
+	}
+	domainSets.Store(&loaded)
+}
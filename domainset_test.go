@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainTrie(t *testing.T) {
+	var trie domainTrie
+	trie.insert("example.com", false)
+	trie.insert("only.example.org", true)
+
+	cases := map[string]bool{
+		"example.com":          true,
+		"www.example.com":      true,
+		"a.b.example.com":      true,
+		"notexample.com":       false,
+		"com":                  false,
+		"only.example.org":     true,
+		"sub.only.example.org": false,
+		"example.org":          false,
+	}
+	for host, want := range cases {
+		if got := trie.match(host); got != want {
+			t.Errorf("match(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestParseDomainListFormats(t *testing.T) {
+	plain, err := parseDomainSet(DomainSetConfig{Name: "plain"}, []byte(
+		"# 注释\nExample.COM\n+.plus.test\nfull:exact.test\nkeyword:tracker\nregexp:^ad[0-9]+\\.\nbogus:x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsmasq, err := parseDomainSet(DomainSetConfig{Name: "cn", Format: domainFormatDnsmasq}, []byte(
+		"server=/baidu.com/114.114.114.114\nserver=/qq.com/weixin.qq.com/114.114.114.114\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		set  *domainSet
+		host string
+		want bool
+	}{
+		{plain, "www.example.com", true},
+		{plain, "a.plus.test", true},
+		{plain, "exact.test", true},
+		{plain, "www.exact.test", false},
+		{plain, "mytracker.net", true},
+		{plain, "ad12.example.net", true},
+		{plain, "bad12.example.net", false},
+		{dnsmasq, "www.baidu.com", true},
+		{dnsmasq, "qq.com", true},
+		{dnsmasq, "114.114.114.114", false},
+		{dnsmasq, "google.com", false},
+	}
+	for _, c := range cases {
+		if got := c.set.match(c.host); got != c.want {
+			t.Errorf("%s: match(%s) = %v, want %v", c.set.name, c.host, got, c.want)
+		}
+	}
+}
+
+// ------------------ geosite.dat 测试数据 ------------------
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoBytes(b []byte, num int, v []byte) []byte {
+	b = appendProtoVarint(b, uint64(num)<<3|2)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// testGeositeDomain 编码一个 Domain 消息
+func testGeositeDomain(typ uint64, value string, attrs ...string) []byte {
+	b := appendProtoVarint(appendProtoVarint(nil, 1<<3), typ)
+	b = appendProtoBytes(b, 2, []byte(value))
+	for _, a := range attrs {
+		b = appendProtoBytes(b, 3, appendProtoBytes(nil, 1, []byte(a)))
+	}
+	return b
+}
+
+func testGeositeEntry(code string, domains ...[]byte) []byte {
+	b := appendProtoBytes(nil, 1, []byte(code))
+	for _, d := range domains {
+		b = appendProtoBytes(b, 2, d)
+	}
+	return b
+}
+
+func testGeositeDat() []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, testGeositeEntry("CN",
+		testGeositeDomain(geositeDomain, "cn"),
+		testGeositeDomain(geositeFull, "www.qq.com"),
+		testGeositeDomain(geositeDomain, "ads.example", "ads"),
+	))
+	b = appendProtoBytes(b, 1, testGeositeEntry("GOOGLE",
+		testGeositeDomain(geositeDomain, "google.com"),
+		testGeositeDomain(geositePlain, "gstatic"),
+		testGeositeDomain(geositeRegex, `^yt[0-9]\.`),
+	))
+	return b
+}
+
+func TestParseGeosite(t *testing.T) {
+	data := testGeositeDat()
+	google, err := parseDomainSet(DomainSetConfig{Name: "google", Format: domainFormatGeosite, Code: "google"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := parseDomainSet(DomainSetConfig{Name: "cn", Format: domainFormatGeosite, Code: "cn"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ads, err := parseDomainSet(DomainSetConfig{Name: "ads", Format: domainFormatGeosite, Code: "cn@ads"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		set  *domainSet
+		host string
+		want bool
+	}{
+		{google, "mail.google.com", true},
+		{google, "fonts.gstatic.net", true},
+		{google, "yt3.ggpht.com", true},
+		{google, "www.qq.com", false},
+		{cn, "gov.cn", true},
+		{cn, "www.qq.com", true},
+		{cn, "qq.com", false},
+		{cn, "x.ads.example", true},
+		{ads, "x.ads.example", true},
+		{ads, "gov.cn", false},
+	}
+	for _, c := range cases {
+		if got := c.set.match(c.host); got != c.want {
+			t.Errorf("%s: match(%s) = %v, want %v", c.set.name, c.host, got, c.want)
+		}
+	}
+
+	if _, err := parseDomainSet(DomainSetConfig{Name: "x", Format: domainFormatGeosite, Code: "nope"}, data); err == nil {
+		t.Error("missing geosite code accepted")
+	}
+	if _, err := parseDomainSet(DomainSetConfig{Name: "x", Format: domainFormatGeosite, Code: "cn"}, data[:len(data)-3]); err == nil {
+		t.Error("truncated geosite data accepted")
+	}
+}
+
+func TestDomainSetRules(t *testing.T) {
+	dir := t.TempDir()
+	geosite := filepath.Join(dir, "geosite.dat")
+	plain := filepath.Join(dir, "direct.txt")
+	os.WriteFile(geosite, testGeositeDat(), 0644)
+	os.WriteFile(plain, []byte("corp.example\n"), 0644)
+	config.DomainSets = []DomainSetConfig{
+		{Name: "google", Source: geosite, Format: domainFormatGeosite, Code: "google"},
+		{Name: "corp", Source: plain},
+	}
+	InitDomainSets()
+	defer func() {
+		config.DomainSets = nil
+		InitDomainSets()
+	}()
+
+	rules := compileRules([]string{
+		"DOMAIN-SET,corp,DIRECT",
+		"DOMAIN-SET,google,PROXY",
+		"DOMAIN-SET,missing,REJECT",
+		"MATCH,REJECT",
+	})
+	if len(rules) != 3 {
+		t.Fatalf("compiled %d rules, want the unknown domain set skipped", len(rules))
+	}
+	cases := map[string]string{
+		"git.corp.example:22":    ActionDirect,
+		"www.google.com:443":     ActionProxy,
+		"WWW.Google.COM.:443":    ActionProxy,
+		"example.org:80":         ActionReject,
+		"1.2.3.4:80":             ActionReject,
+		"ssl.gstatic.com:443":    ActionProxy,
+		"google.com.evil.cn:443": ActionReject,
+	}
+	for target, want := range cases {
+		if got, _ := matchRuleList(rules, target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultFakeIPStore = "cache_fakeip.json"
+	fakeIPTTL          = 1 // 秒，让客户端尽量每次都重新查询，映射以本地表为准
+	fakeIPSaveInterval = time.Minute
+)
+
+// fakeIPPool 是假 IP 地址池，域名和假 IP 一一对应，池满时淘汰最久未使用的映射
+type fakeIPPool struct {
+	ipnet *net.IPNet
+	first uint32 // 第一个可分配地址（跳过网络地址）
+	size  uint32 // 可分配地址数量
+	store string
+
+	mu       sync.Mutex
+	lru      *list.List // 元素为 *fakeIPEntry，前端为最近使用
+	byDomain map[string]*list.Element
+	byIP     map[uint32]*list.Element
+	next     uint32 // 下一个从未分配过的偏移
+	dirty    bool
+}
+
+type fakeIPEntry struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+	ip     uint32
+}
+
+var (
+	fakeIPs        *fakeIPPool // 为 nil 时未启用 fake-ip
+	fakeIPMutex    sync.RWMutex
+	fakeIPSaveOnce sync.Once
+)
+
+// newFakeIPPool 根据 IPv4 网段创建地址池，网络地址和广播地址不分配
+func newFakeIPPool(cidr, store string) (*fakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip4 == nil || bits != 32 {
+		return nil, fmt.Errorf("fake IP range %s is not IPv4", cidr)
+	}
+	if ones > 30 {
+		return nil, fmt.Errorf("fake IP range %s is too small", cidr)
+	}
+	return &fakeIPPool{
+		ipnet:    ipnet,
+		first:    ipToUint32(ip4) + 1,
+		size:     uint32(1)<<(32-ones) - 2,
+		store:    store,
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+// initFakeIP 根据配置启用或关闭 fake-ip，网段不变时保留已有映射
+func initFakeIP() {
+	cidr := config.DNS.FakeIPRange
+	store := fakeIPStorePath(config.DNS.FakeIPStore)
+
+	fakeIPMutex.Lock()
+	defer fakeIPMutex.Unlock()
+	if cidr == "" {
+		if fakeIPs != nil {
+			fakeIPs.save()
+		}
+		fakeIPs = nil
+		return
+	}
+	if fakeIPs != nil && fakeIPs.ipnet.String() == cidr && fakeIPs.store == store {
+		return
+	}
+	pool, err := newFakeIPPool(cidr, store)
+	if err != nil {
+		log.Printf("❌ Fake IP disabled: %v", err)
+		fakeIPs = nil
+		return
+	}
+	if err := pool.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠ Failed to load fake IP mappings from %s: %v", store, err)
+	}
+	if fakeIPs != nil {
+		fakeIPs.save()
+	}
+	fakeIPs = pool
+	log.Printf("✔ Fake IP enabled on %s (%d mappings restored)", pool.ipnet, pool.lru.Len())
+
+	fakeIPSaveOnce.Do(func() { go saveFakeIPsPeriodically() })
+}
+
+// fakeIPStorePath 返回映射表文件的路径，未配置时为 ~/myproxy/cache_fakeip.json，
+// 相对路径也放在配置目录下，不随启动时的工作目录变化
+func fakeIPStorePath(store string) string {
+	if store == "" {
+		store = defaultFakeIPStore
+	}
+	if filepath.IsAbs(store) {
+		return store
+	}
+	dir, err := appDir()
+	if err != nil {
+		log.Printf("⚠ %v, saving fake IP mappings to %s", err, store)
+		return store
+	}
+	return filepath.Join(dir, store)
+}
+
+func currentFakeIPPool() *fakeIPPool {
+	fakeIPMutex.RLock()
+	defer fakeIPMutex.RUnlock()
+	return fakeIPs
+}
+
+// saveFakeIPsPeriodically 定期把有变化的映射写入磁盘
+func saveFakeIPsPeriodically() {
+	for range time.Tick(fakeIPSaveInterval) {
+		if pool := currentFakeIPPool(); pool != nil {
+			pool.save()
+		}
+	}
+}
+
+// lookup 返回域名对应的假 IP，没有时分配一个
+func (p *fakeIPPool) lookup(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.byDomain[domain]; ok {
+		p.lru.MoveToFront(e)
+		return uint32ToIP(e.Value.(*fakeIPEntry).ip)
+	}
+
+	var ip uint32
+	if p.next < p.size {
+		ip = p.first + p.next
+		p.next++
+	} else {
+		// 地址用完，复用最久未使用的映射
+		oldest := p.lru.Back()
+		old := oldest.Value.(*fakeIPEntry)
+		p.lru.Remove(oldest)
+		delete(p.byDomain, old.Domain)
+		delete(p.byIP, old.ip)
+		ip = old.ip
+	}
+	p.insert(&fakeIPEntry{Domain: domain, ip: ip})
+	p.dirty = true
+	return uint32ToIP(ip)
+}
+
+// insert 把映射放到 LRU 前端，调用方持有 p.mu
+func (p *fakeIPPool) insert(entry *fakeIPEntry) {
+	e := p.lru.PushFront(entry)
+	p.byDomain[entry.Domain] = e
+	p.byIP[entry.ip] = e
+}
+
+// domain 返回假 IP 对应的域名
+func (p *fakeIPPool) domain(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.ipnet.Contains(ip4) {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byIP[ipToUint32(ip4)]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).Domain, true
+}
+
+// save 在映射有变化时按从旧到新的顺序写入文件，重新加载后 LRU 顺序不变
+func (p *fakeIPPool) save() {
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return
+	}
+	entries := make([]fakeIPEntry, 0, p.lru.Len())
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeIPEntry)
+		entries = append(entries, fakeIPEntry{Domain: entry.Domain, IP: uint32ToIP(entry.ip).String()})
+	}
+	p.dirty = false
+	p.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = os.WriteFile(p.store, data, 0644)
+	}
+	if err != nil {
+		log.Printf("⚠ Failed to save fake IP mappings to %s: %v", p.store, err)
+	}
+}
+
+// load 从文件恢复映射，不在当前网段内的记录被丢弃
+func (p *fakeIPPool) load() error {
+	data, err := os.ReadFile(p.store)
+	if err != nil {
+		return err
+	}
+	var entries []fakeIPEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range entries {
+		entry := &entries[i]
+		ip := net.ParseIP(entry.IP).To4()
+		if ip == nil || entry.Domain == "" {
+			continue
+		}
+		entry.ip = ipToUint32(ip)
+		if entry.ip < p.first || entry.ip >= p.first+p.size {
+			continue
+		}
+		if _, dup := p.byIP[entry.ip]; dup {
+			continue
+		}
+		if _, dup := p.byDomain[entry.Domain]; dup {
+			continue
+		}
+		p.insert(entry)
+		p.next = max(p.next, entry.ip-p.first+1)
+	}
+	return nil
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// restoreFakeIP 把指向假 IP 的目标地址还原为域名，其余地址原样返回
+func restoreFakeIP(target string) string {
+	pool := currentFakeIPPool()
+	if pool == nil {
+		return target
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return target
+	}
+	if domain, ok := pool.domain(ip); ok {
+		return net.JoinHostPort(domain, port)
+	}
+	return target
+}
+
+// fakeIPFiltered 判断域名是否不使用假 IP（例如局域网域名、NTP 服务器）
+func fakeIPFiltered(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, f := range config.DNS.FakeIPFilter {
+		f = strings.ToLower(strings.TrimPrefix(f, "."))
+		if domain == f || strings.HasSuffix(domain, "."+f) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerFakeIP 在 fake-ip 模式下直接应答 A/AAAA 查询：A 返回假 IP，AAAA 返回空结果。
+// 其他查询或被过滤的域名返回 nil，交给正常的分流解析
+func answerFakeIP(msg []byte) []byte {
+	pool := currentFakeIPPool()
+	if pool == nil {
+		return nil
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil || q.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	domain := strings.TrimSuffix(q.Name.String(), ".")
+	if domain == "" || fakeIPFiltered(domain) {
+		return nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.StartQuestions()
+	b.Question(q)
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], pool.lookup(domain))
+		b.StartAnswers()
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}, a)
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFakeIPPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	// /29 有 6 个可分配地址
+	pool, err := newFakeIPPool("198.18.0.0/29", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := make(map[string]net.IP)
+	for _, d := range []string{"a.test", "b.test", "c.test", "d.test", "e.test", "f.test"} {
+		ips[d] = pool.lookup(d)
+	}
+	if !ips["a.test"].Equal(net.ParseIP("198.18.0.1")) || !ips["f.test"].Equal(net.ParseIP("198.18.0.6")) {
+		t.Fatalf("unexpected allocation: %v", ips)
+	}
+	if ip := pool.lookup("A.test."); !ip.Equal(ips["a.test"]) {
+		t.Fatalf("same domain got a new address %s", ip)
+	}
+
+	// a 刚被使用过，池满时淘汰最久未使用的 b
+	if _, ok := pool.domain(ips["c.test"]); !ok {
+		t.Fatal("c.test mapping missing")
+	}
+	if ip := pool.lookup("g.test"); !ip.Equal(ips["b.test"]) {
+		t.Fatalf("g.test got %s, want b.test's address %s", ip, ips["b.test"])
+	}
+	if d, _ := pool.domain(ips["b.test"]); d != "g.test" {
+		t.Fatalf("reused address maps to %q, want g.test", d)
+	}
+	if _, ok := pool.domain(net.ParseIP("198.18.0.7")); ok {
+		t.Fatal("broadcast address mapped")
+	}
+}
+
+func TestFakeIPPoolPersistence(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "fakeip.json")
+	pool, _ := newFakeIPPool("198.18.0.0/29", store)
+	first := pool.lookup("first.test")
+	second := pool.lookup("second.test")
+	pool.save()
+
+	restored, _ := newFakeIPPool("198.18.0.0/29", store)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := restored.domain(first); d != "first.test" {
+		t.Fatalf("%s restored as %q, want first.test", first, d)
+	}
+	if d, _ := restored.domain(second); d != "second.test" {
+		t.Fatalf("%s restored as %q, want second.test", second, d)
+	}
+	if ip := restored.lookup("third.test"); ip.Equal(first) || ip.Equal(second) {
+		t.Fatalf("new domain reused a restored address %s", ip)
+	}
+}
+
+func TestFakeIPDNSAndRouting(t *testing.T) {
+	useTestChinaRanges(t)
+	upstream := startStandInDNS(t, map[string][]net.IP{"lan.test": {net.ParseIP("192.168.1.10")}})
+	addr := startTestDNSInbound(t, []string{upstream.addr}, []string{upstream.addr})
+	config.DNS.FakeIPRange = "198.18.0.0/15"
+	config.DNS.FakeIPStore = filepath.Join(t.TempDir(), "fakeip.json")
+	config.DNS.FakeIPFilter = []string{"lan.test"}
+	InitResolver()
+
+	client := &udpDNSUpstream{addr: addr}
+	ips, _ := queryA(t, client, "blocked.test")
+	if len(ips) != 1 || !currentFakeIPPool().ipnet.Contains(ips[0]) {
+		t.Fatalf("got %v, want a fake IP", ips)
+	}
+	if lan, _ := queryA(t, client, "lan.test"); len(lan) != 1 || lan[0].String() != "192.168.1.10" {
+		t.Fatalf("filtered domain got %v, want the real address", lan)
+	}
+	if upstream.udpHits.Load() != 2 {
+		t.Fatalf("got %d upstream queries, want only the filtered domain to be forwarded", upstream.udpHits.Load())
+	}
+
+	// AAAA 返回空结果，客户端只会使用假 IPv4
+	msg, _ := buildDNSQuery("blocked.test", dnsmessage.TypeAAAA)
+	resp, err := client.exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v6, _, rcode, _ := parseDNSAnswers(resp); rcode != dnsmessage.RCodeSuccess || len(v6) != 0 {
+		t.Fatalf("AAAA got %v (%s), want an empty answer", v6, rcode)
+	}
+
+	// 连接假 IP 时还原为域名，按域名规则路由
+	config.Rules = []string{"DOMAIN,blocked.test,REJECT", "MATCH,DIRECT"}
+	InitRules()
+	defer func() {
+		config.Rules = nil
+		InitRules()
+	}()
+	target := net.JoinHostPort(ips[0].String(), "443")
+	if got := restoreFakeIP(target); got != "blocked.test:443" {
+		t.Fatalf("restoreFakeIP(%s) = %s", target, got)
+	}
+	if _, err := dialTarget(target); !errors.Is(err, errRejected) {
+		t.Fatalf("dialTarget(%s) = %v, want the domain rule to reject it", target, err)
+	}
+
+	config.DNS.FakeIPRange = ""
+	InitResolver()
+	if got := restoreFakeIP(target); got != target {
+		t.Fatalf("fake IP still restored after disabling: %s", got)
+	}
+}
+
+func TestFakeIPStorePathUnderConfigDir(t *testing.T) {
+	dir, err := appDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	abs := filepath.Join(t.TempDir(), "fakeip.json")
+	cases := map[string]string{
+		"":               filepath.Join(dir, defaultFakeIPStore),
+		"my-fakeip.json": filepath.Join(dir, "my-fakeip.json"),
+		abs:              abs,
+	}
+	for store, want := range cases {
+		if got := fakeIPStorePath(store); got != want {
+			t.Errorf("fakeIPStorePath(%q) = %s, want %s", store, got, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FetchConfig 是远程数据源的下载方式
+type FetchConfig struct {
+	Via     string   `yaml:"via,omitempty" json:"via,omitempty"`         // DIRECT（默认）/ PROXY / 远端代理名称
+	Mirrors []string `yaml:"mirrors,omitempty" json:"mirrors,omitempty"` // 主地址失败时依次尝试的镜像地址
+	Timeout int      `yaml:"timeout,omitempty" json:"timeout,omitempty"` // 单次下载的超时（秒），默认 60
+	Retries *int     `yaml:"retries,omitempty" json:"retries,omitempty"` // 每个地址失败后的重试次数，不写时为 2，0 表示不重试
+}
+
+// SourceConfig 是 china_ips、geoip_db 这类单个数据源的刷新间隔、校验和下载方式，
+// 写法和 ip_sets / domain_sets 每一项的 refresh、verify、via 等字段相同
+type SourceConfig struct {
+	Refresh     string           `yaml:"refresh,omitempty" json:"refresh,omitempty"` // 缓存有效期，如 "24h"，默认 7 天
+	Verify      VerifyConfig     `yaml:"verify,omitempty" json:"verify,omitempty"`
+	FetchConfig `yaml:",inline"` // via、mirrors 等下载方式
+}
+
+const (
+	defaultCacheMaxAge  = 7 * 24 * time.Hour // 远程数据源缓存的默认有效期
+	defaultFetchTimeout = 60 * time.Second
+	defaultFetchRetries = 2
+)
+
+// fetchRetryDelay 是重试前等待的基础时间，第 n 次重试等待 n 倍
+var fetchRetryDelay = time.Second
+
+// remoteListSizeLimit 限制下载的数据源大小，防止异常的响应占满内存和磁盘
+var remoteListSizeLimit int64 = 64 << 20
+
+// parseCacheMaxAge 解析数据源的 refresh 配置，为空时使用默认有效期
+func parseCacheMaxAge(refresh string) (time.Duration, error) {
+	if refresh == "" {
+		return defaultCacheMaxAge, nil
+	}
+	d, err := time.ParseDuration(refresh)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid refresh %q", refresh)
+	}
+	return d, nil
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// newFetchClient 返回经过 f.Via 下载的 HTTP 客户端
+func newFetchClient(f FetchConfig) *http.Client {
+	timeout := defaultFetchTimeout
+	if f.Timeout > 0 {
+		timeout = time.Duration(f.Timeout) * time.Second
+	}
+	via := f.Via
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialVia(via, addr, timeout)
+		},
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: timeout,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// fetchCached 返回数据源对应的本地文件：本地路径原样返回，
+// http(s) 地址下载到缓存目录，缓存在 maxAge 内有效，下载或校验失败时回退到旧缓存
+func fetchCached(source string, maxAge time.Duration, f FetchConfig, validate sourceValidator) (string, error) {
+	if !isRemoteSource(source) {
+		return source, nil
+	}
+	cacheFile := cachePath(source)
+
+	if info, err := os.Stat(cacheFile); err == nil {
+		if time.Since(info.ModTime()) < maxAge {
+			log.Printf("✔ Using cache file %s (valid)", cacheFile)
+			return cacheFile, nil
+		}
+		log.Printf("ℹ Cache file %s is outdated, attempting update", cacheFile)
+	}
+
+	if _, err := fetchRemote(source, f, validate); err != nil {
+		log.Printf("⚠ Remote load failed: %v", err)
+		if _, err := os.Stat(cacheFile); err == nil {
+			log.Printf("✔ Falling back to cache file: %s", cacheFile)
+			return cacheFile, nil
+		}
+		return "", fmt.Errorf("❌ remote load failed and no cache available: %w", err)
+	}
+	return cacheFile, nil
+}
+
+// errNotModified 表示服务器返回 304，缓存仍然有效
+var errNotModified = errors.New("not modified")
+
+// fetchRemote 依次从 source 和镜像下载到 source 的缓存文件，每个地址失败后按 f.Retries 重试。
+// 返回内容是否有变化；304 时只刷新缓存文件的修改时间和检查时间。新内容通过 validate 校验后
+// 先写临时文件再改名替换，校验失败时换下一个地址，缓存保持不变
+func fetchRemote(source string, f FetchConfig, validate sourceValidator) (bool, error) {
+	client := newFetchClient(f)
+	// 每次下载都新建 Transport，结束后关闭空闲连接，否则连接和读写协程会一直留着
+	defer client.CloseIdleConnections()
+	cacheFile := cachePath(source)
+	var meta cacheMeta
+	if _, err := os.Stat(cacheFile); err == nil {
+		meta, _ = readCacheMeta(source)
+	}
+	retries := defaultFetchRetries
+	if f.Retries != nil {
+		retries = max(*f.Retries, 0)
+	}
+
+	var errs []string
+	for _, url := range append([]string{source}, f.Mirrors...) {
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * fetchRetryDelay)
+			}
+			resp, body, err := download(client, url, meta)
+			if err == errNotModified {
+				now := time.Now()
+				if err := os.Chtimes(cacheFile, now, now); err != nil {
+					return false, err
+				}
+				meta.CheckedAt = now
+				writeCacheMeta(source, meta)
+				log.Printf("✔ Remote file not modified: %s", url)
+				return false, nil
+			}
+			if err == nil {
+				entries, err := validate(body, url, client)
+				if err != nil {
+					// 内容有问题，重试同一地址没有意义
+					errs = append(errs, fmt.Sprintf("rejected %s: %v", url, err))
+					break
+				}
+				now := time.Now()
+				return true, storeCache(source, body, cacheMeta{
+					Source:       source,
+					URL:          url,
+					FetchedAt:    now,
+					CheckedAt:    now,
+					ETag:         resp.Header.Get("ETag"),
+					LastModified: resp.Header.Get("Last-Modified"),
+					Entries:      entries,
+				})
+			}
+			errs = append(errs, err.Error())
+			if !retryableFetchError(resp) {
+				break
+			}
+		}
+	}
+	return false, errors.New(strings.Join(errs, "; "))
+}
+
+// download 发送一次请求；缓存来自同一地址时带上 If-None-Match / If-Modified-Since
+func download(client *http.Client, url string, meta cacheMeta) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.URL == url {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	log.Printf("🌐 Fetching remote file: %s", url)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if meta.URL == url {
+			return resp, nil, errNotModified
+		}
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, remoteListSizeLimit+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s failed: %v", url, err) // 连接中断，可以重试
+		}
+		if int64(len(body)) > remoteListSizeLimit {
+			return resp, nil, fmt.Errorf("%s is larger than %d bytes", url, remoteListSizeLimit)
+		}
+		return resp, body, nil
+	}
+	return resp, nil, fmt.Errorf("fetch %s: unexpected status %s", url, resp.Status)
+}
+
+// retryableFetchError 判断失败是否值得重试：网络错误和 5xx、429 重试，其余状态码不重试
+func retryableFetchError(resp *http.Response) bool {
+	return resp == nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// storeCache 先写临时文件再改名替换缓存，然后记录条件请求需要的元数据
+func storeCache(source string, body []byte, meta cacheMeta) error {
+	cacheFile := cachePath(source)
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0755); err != nil {
+		return err
+	}
+	tmp := cacheFile + ".tmp"
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cacheFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	writeCacheMeta(source, meta)
+	log.Printf("✔ Cache updated: %s (%d entries from %s)", cacheFile, meta.Entries, meta.URL)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// useFastFetchRetries 让测试中的重试不等待
+func useFastFetchRetries(t *testing.T) {
+	saved := fetchRetryDelay
+	fetchRetryDelay = time.Millisecond
+	t.Cleanup(func() { fetchRetryDelay = saved })
+}
+
+func fetchRetries(n int) *int { return &n }
+
+func TestFetchRemoteRetriesAndFallsBackToMirror(t *testing.T) {
+	useTestCacheDir(t)
+	useFastFetchRetries(t)
+
+	var flakyHits, brokenHits, htmlHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky": // 第三次请求才成功
+			if flakyHits.Add(1) < 3 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("1.0.0.0/8\n"))
+		case "/broken":
+			brokenHits.Add(1)
+			http.Error(w, "down", http.StatusBadGateway)
+		case "/html":
+			htmlHits.Add(1)
+			w.Write([]byte("<html>blocked</html>"))
+		case "/mirror":
+			w.Write([]byte("2.0.0.0/8\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+
+	if _, err := fetchRemote(srv.URL+"/flaky", FetchConfig{}, validate); err != nil {
+		t.Fatalf("flaky source: %v", err)
+	}
+	if flakyHits.Load() != 3 {
+		t.Errorf("flaky source requested %d times, want 3", flakyHits.Load())
+	}
+
+	// 5xx 按 retries 重试，错误页面不重试，404 不重试，最后使用镜像
+	f := FetchConfig{Retries: fetchRetries(1), Mirrors: []string{srv.URL + "/html", srv.URL + "/missing", srv.URL + "/mirror"}}
+	if _, err := fetchRemote(srv.URL+"/broken", f, validate); err != nil {
+		t.Fatalf("mirror fallback: %v", err)
+	}
+	if brokenHits.Load() != 2 || htmlHits.Load() != 1 {
+		t.Errorf("broken requested %d times, html %d times; want 2 and 1", brokenHits.Load(), htmlHits.Load())
+	}
+	if data, _ := os.ReadFile(cachePath(srv.URL + "/broken")); string(data) != "2.0.0.0/8\n" {
+		t.Errorf("cache = %q, want the mirror's content", data)
+	}
+
+	f.Mirrors = []string{srv.URL + "/html"}
+	if _, err := fetchRemote(srv.URL+"/broken", f, validate); err == nil ||
+		!strings.Contains(err.Error(), "502") || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("error %v should mention every failed source", err)
+	}
+
+	// retries: 0 表示不重试
+	brokenHits.Store(0)
+	if _, err := fetchRemote(srv.URL+"/broken", FetchConfig{Retries: fetchRetries(0)}, validate); err == nil {
+		t.Fatal("broken source accepted")
+	}
+	if brokenHits.Load() != 1 {
+		t.Errorf("retries 0: broken requested %d times, want 1", brokenHits.Load())
+	}
+}
+
+func TestFetchRemoteClosesConnections(t *testing.T) {
+	useTestCacheDir(t)
+	var opened, closed atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1.0.0.0/8\n"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// 每次下载用完的 keep-alive 连接要关闭，定期刷新不会越积越多
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+	for i := 0; i < 3; i++ {
+		if _, err := fetchRemote(srv.URL+"/cn.txt", FetchConfig{}, validate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() < opened.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if opened.Load() != 3 || closed.Load() != 3 {
+		t.Errorf("%d connections opened, %d closed; want 3 and 3", opened.Load(), closed.Load())
+	}
+}
+
+func TestFetchRemoteThroughUpstreamProxy(t *testing.T) {
+	useTestCacheDir(t)
+	useFastFetchRetries(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1.0.0.0/8\n"))
+	}))
+	defer origin.Close()
+
+	stand := &standInHTTPProxy{}
+	upstreamSrv := httptest.NewServer(stand)
+	defer upstreamSrv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+	config.Proxies = []UpstreamConfig{{Name: "cloud", Type: "http", Server: host, Port: portNum}}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+	for _, via := range []string{"cloud", "proxy"} {
+		stand.requests = nil
+		if _, err := fetchRemote(origin.URL+"/cn.txt", FetchConfig{Via: via}, validate); err != nil {
+			t.Fatalf("via %s: %v", via, err)
+		}
+		want := "CONNECT " + strings.TrimPrefix(origin.URL, "http://")
+		if len(stand.requests) != 1 || stand.requests[0] != want {
+			t.Fatalf("via %s: upstream proxy saw %v, want %q", via, stand.requests, want)
+		}
+	}
+
+	if _, err := fetchRemote(origin.URL+"/cn.txt", FetchConfig{Via: "nope", Retries: fetchRetries(1)}, validate); err == nil {
+		t.Fatal("unknown via accepted")
+	}
+}
+
+func TestSourceConfigYAML(t *testing.T) {
+	data := `
+china_ips: "https://example.com/cn.txt"
+china_ips_source:
+  refresh: "24h"
+  verify:
+    min_entries: 3000
+  via: PROXY
+  mirrors: ["https://mirror.example/cn.txt"]
+  retries: 0
+geoip_db_source:
+  refresh: "168h"
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cn := cfg.ChinaIpsSource
+	if cn.Refresh != "24h" || cn.Verify.MinEntries != 3000 || cn.Via != "PROXY" ||
+		len(cn.Mirrors) != 1 || cn.Retries == nil || *cn.Retries != 0 {
+		t.Errorf("china_ips_source = %+v", cn)
+	}
+	if cfg.GeoIPDBSource.Refresh != "168h" || cfg.GeoIPDBSource.Via != "" {
+		t.Errorf("geoip_db_source = %+v", cfg.GeoIPDBSource)
+	}
+}
@@ -6,10 +6,8 @@ import (
 )
 
 func TestIsIPInRanges_LocalNetworks(t *testing.T) {
-	// 准备：只注入局域网网段
-	ipv4Ranges = nil
-	ipv6Ranges = nil
-	appendLocalNetworkRanges()
+	// 准备：cn 集合为空，只有局域网网段
+	useTestChinaRanges(t)
 
 	cases := []struct {
 		ip     string
@@ -4,6 +4,7 @@ go 1.24
 
 require (
 	github.com/getlantern/systray v1.2.2
+	golang.org/x/crypto v0.39.0
 	golang.org/x/net v0.41.0
 	golang.org/x/sys v0.33.0
 	gopkg.in/yaml.v2 v2.4.0
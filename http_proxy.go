@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -42,8 +44,11 @@ func shouldRewriteHeader(host string) bool {
 		if ip := net.ParseIP(hostOnly); ip != nil {
 			return !IsPrivateIP(ip)
 		}
-		// 若是域名，解析 IP 并判断
-		ips, err := net.LookupIP(hostOnly)
+		// 若是域名，解析 IP 并判断；不允许本地解析时按需要改写处理
+		if !localResolveAllowed() {
+			return true
+		}
+		ips, err := lookupIP(hostOnly)
 		if err != nil {
 			return true // 保守起见，失败时仍进行修改
 		}
@@ -65,23 +70,52 @@ func modifyHeaders(req *http.Request) {
 	}
 }
 
-// httpProxyHandler 处理 HTTP 代理请求，包括 CONNECT 和普通 HTTP 请求
-func httpProxyHandler(w http.ResponseWriter, req *http.Request) {
+// httpProxyHandler 返回入口 in 的 HTTP 代理处理函数，包括 CONNECT 和普通 HTTP 请求
+func httpProxyHandler(in *inbound) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		serveHTTPProxy(w, req, in)
+	}
+}
+
+func serveHTTPProxy(w http.ResponseWriter, req *http.Request, in *inbound) {
 	target := req.Host
 	if req.URL.Host != "" {
 		target = req.URL.Host
 	}
-	log.Printf("HTTP proxy request for %s", target)
+	user, ok := in.checkProxyAuthorization(req)
+	if !ok {
+		log.Printf("HTTP proxy auth failed for %s from %s", target, req.RemoteAddr)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="myproxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	if user != "" {
+		log.Printf("HTTP proxy request for %s (user: %s)", target, user)
+	} else {
+		log.Printf("HTTP proxy request for %s", target)
+	}
 	if strings.ToUpper(req.Method) == "CONNECT" {
-		handleHTTPConnect(w, req)
+		handleHTTPConnect(w, req, in)
 		return
 	}
-	// 非 CONNECT 请求，使用自定义 transport，通过 dialTarget 建立连接
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialTarget(addr)
-		},
+	// 非 CONNECT 请求，使用自定义 transport，按路由结果建立连接
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "80")
+	}
+	action := in.route(target)
+	if action == ActionReject {
+		http.Error(w, "rejected by rule", http.StatusForbidden)
+		return
 	}
+	transport, forward := httpTransportFor(action)
+	if forward != "" {
+		log.Printf("HTTP forward %s -> %s", target, forward)
+	}
+
+	// 客户端的代理认证头只对本地代理有效，不能转发出去；
+	// 远端代理的认证由 dialRoute 使用的 dialer 负责
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
 
 	// 改写请求头
 	if shouldRewriteHeader(req.Host) {
@@ -99,10 +133,54 @@ func httpProxyHandler(w http.ResponseWriter, req *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
+// httpTransports 按路由动作缓存普通 HTTP 请求使用的 Transport，复用到目标或远端代理的 keep-alive 连接
+var (
+	httpTransports      = make(map[string]*http.Transport)
+	httpTransportsMutex sync.Mutex
+)
+
+// httpTransportFor 返回动作对应的 Transport。动作是 HTTP 远端代理时直接转发带完整 URL 的请求，
+// 不再先建立 CONNECT 隧道，forward 为该代理的名称
+func httpTransportFor(action string) (transport *http.Transport, forward string) {
+	httpTransportsMutex.Lock()
+	defer httpTransportsMutex.Unlock()
+	var up *upstream
+	if action != ActionDirect {
+		if u, err := getUpstream(action); err == nil && u.isHTTP() {
+			up, forward = u, u.cfg.Name
+		}
+	}
+	if t, ok := httpTransports[action]; ok {
+		return t, forward
+	}
+	transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialRoute(action, addr)
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+	if up != nil {
+		transport.Proxy = http.ProxyURL(up.proxyURL())
+		transport.DialContext = outboundDialer(upstreamHandshakeTimeout).DialContext
+	}
+	httpTransports[action] = transport
+	return transport, forward
+}
+
+// resetHTTPTransports 关闭缓存的 Transport 的空闲连接并清空缓存，远端代理重新加载后调用
+func resetHTTPTransports() {
+	httpTransportsMutex.Lock()
+	defer httpTransportsMutex.Unlock()
+	for _, t := range httpTransports {
+		t.CloseIdleConnections()
+	}
+	httpTransports = make(map[string]*http.Transport)
+}
+
 // handleHTTPConnect 处理 HTTPS 的 CONNECT 请求
-func handleHTTPConnect(w http.ResponseWriter, req *http.Request) {
+func handleHTTPConnect(w http.ResponseWriter, req *http.Request, in *inbound) {
 	target := req.Host
-	conn, err := dialTarget(target)
+	conn, err := in.dial(target)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
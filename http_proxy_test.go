@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPProxyAuthorization(t *testing.T) {
+	origin := newOriginServer(t)
+	config.Users = []UserConfig{{Username: "alice", Password: "secret"}}
+	config.Rules = []string{"MATCH,DIRECT"}
+	InitRules()
+	defer func() {
+		config.Users = nil
+		config.Rules = nil
+		InitRules()
+	}()
+
+	local := httptest.NewServer(httpProxyHandler(nil))
+	defer local.Close()
+
+	cases := []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{url.UserPassword("alice", "secret"), http.StatusOK},
+	}
+	for _, c := range cases {
+		proxyURL, _ := url.Parse(local.URL)
+		proxyURL.User = c.user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatalf("GET through local proxy failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("user %v: status = %d; want %d", c.user, resp.StatusCode, c.status)
+		}
+		if c.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("407 response without Proxy-Authenticate")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstreamHandshakeTimeout 限制与 HTTP 远端代理完成 CONNECT 握手的时间
+const upstreamHandshakeTimeout = 15 * time.Second
+
+// httpConnectDialer 通过 HTTP 代理的 CONNECT 方法建立隧道
+type httpConnectDialer struct {
+	addr     string
+	username string
+	password string
+	forward  proxy.Dialer
+}
+
+// proxyAuthorization 返回 Proxy-Authorization 头的值，未配置用户名时返回空串
+func (d *httpConnectDialer) proxyAuthorization() string {
+	if d.username == "" {
+		return ""
+	}
+	return basicAuth(d.username, d.password)
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := d.proxyAuthorization(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// 先关闭连接，避免关闭 Body 时等待长度未知的错误页读完
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s CONNECT %s failed: %s", d.addr, addr, resp.Status)
+	}
+	// 200 之后的数据属于隧道，不能关闭 Body，否则会一直读到连接结束
+	conn.SetDeadline(time.Time{})
+
+	// 远端可能在响应之后立即发送了数据，这部分已经进入缓冲区
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读出 bufio.Reader 中已缓冲的数据，再继续从底层连接读取
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// standInHTTPProxy 是测试用的 HTTP 代理，支持 CONNECT 和完整 URL 的普通请求
+type standInHTTPProxy struct {
+	auth string // 期望的 Proxy-Authorization，为空则不校验
+
+	mu       sync.Mutex // 请求可能并发到达，例如同时查询 A 和 AAAA
+	requests []string
+}
+
+// seen 返回目前收到的请求，reset 为 true 时清空记录
+func (p *standInHTTPProxy) seen(reset bool) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	requests := p.requests
+	if reset {
+		p.requests = nil
+	}
+	return requests
+}
+
+func (p *standInHTTPProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	p.requests = append(p.requests, req.Method+" "+req.RequestURI)
+	p.mu.Unlock()
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="stand-in"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		remote, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			remote.Close()
+			return
+		}
+		done := make(chan struct{}, 2)
+		go transferData(remote, client, done)
+		go transferData(client, remote, done)
+		<-done
+		return
+	}
+	if !req.URL.IsAbs() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func newOriginServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from origin")
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	origin := newOriginServer(t)
+	stand := &standInHTTPProxy{auth: basicAuth("alice", "secret")}
+	upstreamSrv := httptest.NewServer(stand)
+	defer upstreamSrv.Close()
+	upstreamAddr := strings.TrimPrefix(upstreamSrv.URL, "http://")
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+
+	d := &httpConnectDialer{addr: upstreamAddr, username: "alice", password: "secret", forward: proxy.Direct}
+	conn, err := d.Dial("tcp", originAddr)
+	if err != nil {
+		t.Fatalf("Dial through stand-in proxy failed: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+originAddr+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response through tunnel: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello from origin" {
+		t.Errorf("body = %q", body)
+	}
+
+	bad := &httpConnectDialer{addr: upstreamAddr, username: "alice", password: "wrong", forward: proxy.Direct}
+	if conn, err := bad.Dial("tcp", originAddr); err == nil {
+		conn.Close()
+		t.Errorf("Dial with wrong credentials should fail")
+	}
+}
+
+func TestHTTPProxyHandlerForwardsToHTTPUpstream(t *testing.T) {
+	origin := newOriginServer(t)
+	stand := &standInHTTPProxy{auth: basicAuth("alice", "secret")}
+	upstreamSrv := httptest.NewServer(stand)
+	defer upstreamSrv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+
+	config.Proxies = []UpstreamConfig{{Name: "cloud", Type: "http", Server: host, Port: portNum, Username: "alice", Password: "secret"}}
+	config.Rules = []string{"MATCH,cloud"}
+	InitUpstreams()
+	InitRules()
+	defer func() {
+		config.Proxies = nil
+		config.Rules = nil
+		InitUpstreams()
+		InitRules()
+	}()
+
+	local := httptest.NewServer(httpProxyHandler(nil))
+	defer local.Close()
+	localURL, _ := url.Parse(local.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(localURL)}}
+
+	resp, err := client.Get(origin.URL + "/path")
+	if err != nil {
+		t.Fatalf("GET through local proxy failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from origin" {
+		t.Errorf("body = %q", body)
+	}
+	if seen := stand.seen(false); len(seen) != 1 || seen[0] != "GET "+origin.URL+"/path" {
+		t.Errorf("stand-in proxy saw %v; want a single absolute-URI GET", seen)
+	}
+}
+
+// getThroughUpstream 经注册表中名为 name 的远端代理请求 origin
+func getThroughUpstream(t *testing.T, name string, origin *httptest.Server) (string, error) {
+	t.Helper()
+	d, err := getUpstreamDialer(name)
+	if err != nil {
+		return "", err
+	}
+	conn, err := d.Dial("tcp", strings.TrimPrefix(origin.URL, "http://"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body), nil
+}
+
+func TestUpstreamCredentialsFromConfig(t *testing.T) {
+	origin := newOriginServer(t)
+	config.Users = []UserConfig{{Username: "alice", Password: "secret"}}
+	socksHost, socksPort, _ := net.SplitHostPort(startTestSocks5(t))
+	socksPortNum, _ := strconv.Atoi(socksPort)
+	httpSrv := httptest.NewServer(&standInHTTPProxy{auth: basicAuth("bob", "hunter2")})
+	defer httpSrv.Close()
+	httpHost, httpPort, _ := net.SplitHostPort(strings.TrimPrefix(httpSrv.URL, "http://"))
+	httpPortNum, _ := strconv.Atoi(httpPort)
+
+	config.Proxies = []UpstreamConfig{
+		{Name: "socks", Type: "socks5", Server: socksHost, Port: socksPortNum, Username: "alice", Password: "secret"},
+		{Name: "socks-bad", Type: "socks5", Server: socksHost, Port: socksPortNum, Username: "alice", Password: "wrong"},
+		{Name: "http", Type: "http", Server: httpHost, Port: httpPortNum, Username: "bob", Password: "hunter2"},
+		{Name: "http-anon", Type: "http", Server: httpHost, Port: httpPortNum},
+	}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	for name, ok := range map[string]bool{"socks": true, "socks-bad": false, "http": true, "http-anon": false} {
+		body, err := getThroughUpstream(t, name, origin)
+		if (err == nil && body == "hello from origin") != ok {
+			t.Errorf("%s: body %q, err %v; want ok=%v", name, body, err, ok)
+		}
+	}
+
+	// 旧的 default_target 也带上认证
+	config.Proxies = nil
+	config.RemoteMode = "socks5"
+	config.DefaultTarget.IP, config.DefaultTarget.Port = socksHost, socksPortNum
+	config.DefaultTarget.Username, config.DefaultTarget.Password = "alice", "secret"
+	defer func() {
+		config.RemoteMode = ""
+		config.DefaultTarget.IP, config.DefaultTarget.Port = "", 0
+		config.DefaultTarget.Username, config.DefaultTarget.Password = "", ""
+	}()
+	InitUpstreams()
+	if body, err := getThroughUpstream(t, "", origin); err != nil || body != "hello from origin" {
+		t.Errorf("default_target: body %q, err %v", body, err)
+	}
+}
+
+func TestHTTPProxyHandlerReusesUpstreamConnections(t *testing.T) {
+	origin := newOriginServer(t)
+	var opened, closed atomic.Int32
+	upstreamSrv := httptest.NewUnstartedServer(&standInHTTPProxy{})
+	upstreamSrv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	upstreamSrv.Start()
+	defer upstreamSrv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+
+	config.Proxies = []UpstreamConfig{{Name: "cloud", Type: "http", Server: host, Port: portNum}}
+	config.Rules = []string{"MATCH,cloud"}
+	InitUpstreams()
+	InitRules()
+	defer func() {
+		config.Proxies = nil
+		config.Rules = nil
+		InitUpstreams()
+		InitRules()
+	}()
+
+	local := httptest.NewServer(httpProxyHandler(nil))
+	defer local.Close()
+	localURL, _ := url.Parse(local.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(localURL)}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if opened.Load() != 1 {
+		t.Errorf("%d connections to the upstream for 3 requests, want 1 reused connection", opened.Load())
+	}
+
+	// 重新加载远端代理后，旧的空闲连接被关闭
+	InitUpstreams()
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() < opened.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if closed.Load() != opened.Load() {
+		t.Errorf("%d of %d upstream connections closed after reload", closed.Load(), opened.Load())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// InboundConfig 定义一个本地监听入口，users 和 rules 为空时使用全局配置
+type InboundConfig struct {
+	Name     string `yaml:"name" json:"name"`
+	Protocol string `yaml:"protocol" json:"protocol"` // http、socks5（兼容 SOCKS4/4a）、mixed、dns，Linux 上还支持 redirect 和 tproxy
+	Listen   string `yaml:"listen" json:"listen"`
+	Port     int    `yaml:"port" json:"port"`
+
+	Users []UserConfig `yaml:"users,omitempty" json:"users,omitempty"` // 覆盖全局 users
+	Rules []string     `yaml:"rules,omitempty" json:"rules,omitempty"` // 先于全局 rules 匹配
+}
+
+func (c InboundConfig) addr() string {
+	return fmt.Sprintf("%s:%d", c.Listen, c.Port)
+}
+
+func (c InboundConfig) protocol() string {
+	return strings.ToLower(c.Protocol)
+}
+
+// sameListener 判断两个配置是否对应同一个监听套接字，相同时只需原地更新认证和规则
+func (c InboundConfig) sameListener(o InboundConfig) bool {
+	return c.protocol() == o.protocol() && c.addr() == o.addr()
+}
+
+// inbound 是一个正在运行的监听。处理函数收到 nil 时表示没有具体入口，使用全局配置
+type inbound struct {
+	cfg InboundConfig
+	ln  net.Listener
+	pc  net.PacketConn // 仅 dns 和 tproxy 入口使用，与 ln 同一地址
+
+	mu    sync.RWMutex
+	users []UserConfig
+	rules []Rule
+}
+
+func newInbound(cfg InboundConfig, ln net.Listener) *inbound {
+	in := &inbound{cfg: cfg, ln: ln}
+	in.update(cfg)
+	return in
+}
+
+// update 原地替换认证和路由覆盖，不影响已经建立的连接
+func (in *inbound) update(cfg InboundConfig) {
+	rules := compileRules(cfg.Rules)
+	in.mu.Lock()
+	in.users = cfg.Users
+	in.rules = rules
+	in.mu.Unlock()
+}
+
+// userTable 返回该入口生效的用户表
+func (in *inbound) userTable() []UserConfig {
+	if in != nil {
+		in.mu.RLock()
+		defer in.mu.RUnlock()
+		if len(in.users) > 0 {
+			return in.users
+		}
+	}
+	return config.Users
+}
+
+// authRequired 判断该入口是否需要认证
+func (in *inbound) authRequired() bool {
+	return len(in.userTable()) > 0
+}
+
+// checkUser 按该入口的用户表校验用户名和密码
+func (in *inbound) checkUser(username, password string) bool {
+	return checkUser(in.userTable(), username, password)
+}
+
+// route 先匹配入口自己的规则，未命中时使用全局路由
+func (in *inbound) route(target string) string {
+	target = restoreFakeIP(target)
+	if in != nil {
+		in.mu.RLock()
+		rules := in.rules
+		in.mu.RUnlock()
+		if action, ok := matchRuleList(rules, target); ok {
+			return action
+		}
+	}
+	return routeTarget(target)
+}
+
+// dial 按该入口的路由建立连接
+func (in *inbound) dial(target string) (net.Conn, error) {
+	return dialRoute(in.route(target), target)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// drainTray 在测试中消费托盘状态，避免 UpdateTray 阻塞
+func drainTray(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-trayState.Channel():
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(done) })
+}
+
+func runningAddr(t *testing.T, name string) string {
+	t.Helper()
+	inboundsMutex.Lock()
+	defer inboundsMutex.Unlock()
+	in, ok := inbounds[name]
+	if !ok {
+		t.Fatalf("inbound %s is not running", name)
+	}
+	return in.ln.Addr().String()
+}
+
+func TestInboundRegistry(t *testing.T) {
+	drainTray(t)
+	origin := newOriginServer(t)
+	config.Rules = []string{"MATCH,DIRECT"}
+	InitRules()
+	cfgs := []InboundConfig{
+		{Name: "web", Protocol: "http", Listen: "127.0.0.1", Port: 0},
+		{Name: "sock", Protocol: "socks5", Listen: "127.0.0.1", Port: 0,
+			Users: []UserConfig{{Username: "bob", Password: "pw"}}},
+	}
+	applyInbounds(cfgs)
+	defer func() {
+		applyInbounds(nil)
+		config.Rules = nil
+		InitRules()
+	}()
+
+	webURL, _ := url.Parse("http://" + runningAddr(t, "web"))
+	webClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(webURL)}}
+	sockDialer, _ := proxy.SOCKS5("tcp", runningAddr(t, "sock"), &proxy.Auth{User: "bob", Password: "pw"}, proxy.Direct)
+	sockClient := &http.Client{Transport: &http.Transport{Dial: sockDialer.Dial, DisableKeepAlives: true}}
+
+	get := func(client *http.Client) error {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(webClient); err != nil {
+		t.Errorf("http inbound: %v", err)
+	}
+	if err := get(sockClient); err != nil {
+		t.Errorf("socks5 inbound with per-inbound user: %v", err)
+	}
+
+	// 停止一个入口不影响另一个
+	if err := stopInbound("web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(sockClient); err != nil {
+		t.Errorf("socks5 inbound after stopping http inbound: %v", err)
+	}
+
+	// 只修改用户表时原地更新，监听地址不变
+	sockAddr := runningAddr(t, "sock")
+	cfgs[1].Users = []UserConfig{{Username: "bob", Password: "new"}}
+	applyInbounds(cfgs)
+	if runningAddr(t, "sock") != sockAddr {
+		t.Errorf("socks5 inbound was restarted for a users-only change")
+	}
+	if err := get(sockClient); err == nil {
+		t.Errorf("old password should be rejected after update")
+	}
+	// 被手动停止的入口在重新应用配置时再次启动
+	runningAddr(t, "web")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cmp"
+	"sort"
+)
+
+// ipRange 是闭区间 [start, end]，IPv4 用 uint32，IPv6 用 16 字节大端地址
+type ipRange[T uint32 | [16]byte] struct{ start, end T }
+
+type IPv4Range = ipRange[uint32]
+type IPv6Range = ipRange[[16]byte]
+
+// rangeFamily 提供一种地址族的比较和加减一，区间运算在此基础上实现。
+// 规范化的区间表按起点排序，互不重叠也不相邻
+type rangeFamily[T uint32 | [16]byte] struct {
+	cmp  func(a, b T) int
+	next func(a T) (T, bool) // a+1，溢出时返回 false
+	prev func(a T) (T, bool) // a-1，下溢时返回 false
+}
+
+var v4Family = rangeFamily[uint32]{
+	cmp:  cmp.Compare[uint32],
+	next: func(a uint32) (uint32, bool) { return a + 1, a != ^uint32(0) },
+	prev: func(a uint32) (uint32, bool) { return a - 1, a != 0 },
+}
+
+var v6Family = rangeFamily[[16]byte]{
+	cmp: compare16,
+	next: func(a [16]byte) ([16]byte, bool) {
+		for i := 15; i >= 0; i-- {
+			if a[i]++; a[i] != 0 {
+				return a, true
+			}
+		}
+		return a, false
+	},
+	prev: func(a [16]byte) ([16]byte, bool) {
+		for i := 15; i >= 0; i-- {
+			if a[i]--; a[i] != 0xff {
+				return a, true
+			}
+		}
+		return a, false
+	},
+}
+
+// normalize 排序并合并重叠和相邻的区间，返回新的区间表
+func (f rangeFamily[T]) normalize(rs []ipRange[T]) []ipRange[T] {
+	sorted := append([]ipRange[T](nil), rs...)
+	sort.Slice(sorted, func(i, j int) bool { return f.cmp(sorted[i].start, sorted[j].start) < 0 })
+
+	out := make([]ipRange[T], 0, len(sorted))
+	for _, r := range sorted {
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			next, ok := f.next(last.end)
+			if !ok || f.cmp(r.start, next) <= 0 { // 重叠或相邻
+				if f.cmp(r.end, last.end) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// contains 在规范化的区间表中二分查找
+func (f rangeFamily[T]) contains(rs []ipRange[T], a T) bool {
+	i := sort.Search(len(rs), func(i int) bool { return f.cmp(rs[i].end, a) >= 0 })
+	return i < len(rs) && f.cmp(rs[i].start, a) <= 0
+}
+
+func (f rangeFamily[T]) union(a, b []ipRange[T]) []ipRange[T] {
+	return f.normalize(append(append([]ipRange[T](nil), a...), b...))
+}
+
+// intersect 求两个规范化区间表的交集
+func (f rangeFamily[T]) intersect(a, b []ipRange[T]) []ipRange[T] {
+	var out []ipRange[T]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].start, a[i].end
+		if f.cmp(b[j].start, start) > 0 {
+			start = b[j].start
+		}
+		if f.cmp(b[j].end, end) < 0 {
+			end = b[j].end
+		}
+		if f.cmp(start, end) <= 0 {
+			out = append(out, ipRange[T]{start, end})
+		}
+		if f.cmp(a[i].end, b[j].end) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+// difference 求 a 中去掉 b 之后的部分，两者都必须是规范化的区间表
+func (f rangeFamily[T]) difference(a, b []ipRange[T]) []ipRange[T] {
+	var out []ipRange[T]
+	j := 0
+	for _, r := range a {
+		start := r.start
+		covered := false
+		for ; j < len(b) && f.cmp(b[j].end, start) < 0; j++ {
+		}
+		for k := j; k < len(b) && f.cmp(b[k].start, r.end) <= 0; k++ {
+			if f.cmp(b[k].start, start) > 0 {
+				end, _ := f.prev(b[k].start)
+				out = append(out, ipRange[T]{start, end})
+			}
+			next, ok := f.next(b[k].end)
+			if !ok || f.cmp(b[k].end, r.end) >= 0 {
+				covered = true
+				break
+			}
+			start = next
+		}
+		if !covered {
+			out = append(out, ipRange[T]{start, r.end})
+		}
+	}
+	return out
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustParseIPSet(t testing.TB, cidrs ...string) *ipSet {
+	t.Helper()
+	s, err := parseIPSet("test", strings.NewReader(strings.Join(cidrs, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestIPSetMergesRanges(t *testing.T) {
+	s := mustParseIPSet(t,
+		"10.0.0.0/9", "10.128.0.0/9", // 相邻
+		"192.168.0.0/16", "192.168.1.0/24", // 包含
+		"0.0.0.0/1", "1.2.3.4", // 包含
+		"255.255.255.255", // 地址空间末尾
+		"2001:db8::/33", "2001:db8:8000::/33", "ffff::/16",
+	)
+	want4 := []IPv4Range{
+		{0x00000000, 0x7fffffff},
+		{0xc0a80000, 0xc0a8ffff},
+		{0xffffffff, 0xffffffff},
+	}
+	if len(s.v4) != len(want4) {
+		t.Fatalf("v4 = %v, want %v", s.v4, want4)
+	}
+	for i := range want4 {
+		if s.v4[i] != want4[i] {
+			t.Errorf("v4[%d] = %v, want %v", i, s.v4[i], want4[i])
+		}
+	}
+	if len(s.v6) != 2 {
+		t.Errorf("v6 has %d ranges, want 2 after merging 2001:db8::/32", len(s.v6))
+	}
+
+	// 未合并时，大网段后面的小网段会让二分查找出错
+	if !s.contains(net.ParseIP("100.1.1.1")) {
+		t.Error("100.1.1.1 lost inside 0.0.0.0/1")
+	}
+}
+
+func TestIPSetOperations(t *testing.T) {
+	a := mustParseIPSet(t, "10.0.0.0/8", "2001:db8::/32")
+	b := mustParseIPSet(t, "10.1.0.0/16", "10.3.0.0/16", "11.0.0.0/8", "2001:db8:1::/48")
+
+	cases := []struct {
+		op   string
+		set  *ipSet
+		ip   string
+		want bool
+	}{
+		{"union", a.union(b), "11.1.1.1", true},
+		{"union", a.union(b), "10.2.0.1", true},
+		{"intersect", a.intersect(b), "10.1.2.3", true},
+		{"intersect", a.intersect(b), "10.2.0.1", false},
+		{"intersect", a.intersect(b), "11.1.1.1", false},
+		{"intersect", a.intersect(b), "2001:db8:1::1", true},
+		{"difference", a.difference(b), "10.0.255.255", true},
+		{"difference", a.difference(b), "10.1.0.0", false},
+		{"difference", a.difference(b), "10.2.0.0", true},
+		{"difference", a.difference(b), "10.4.0.0", true},
+		{"difference", a.difference(b), "2001:db8:1::1", false},
+		{"difference", a.difference(b), "2001:db8:2::1", true},
+	}
+	for _, c := range cases {
+		if got := c.set.contains(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%s contains(%s) = %v, want %v", c.op, c.ip, got, c.want)
+		}
+	}
+	if d := a.difference(b); len(d.v4) != 3 {
+		t.Errorf("difference v4 = %v, want 3 ranges", d.v4)
+	}
+}
+
+// ------------------ 模糊测试：与逐个 net.IPNet 比较的朴素实现对照 ------------------
+
+// fuzzCIDRs 把字节串切成一组网段：标志字节为偶数时取 4 字节 IPv4 地址和前缀长度，否则取 16 字节 IPv6 地址。
+// IPv6 只取前 4 字节随机、其余为 0，让网段更容易重叠
+func fuzzCIDRs(data []byte) []*net.IPNet {
+	var nets []*net.IPNet
+	for len(data) >= 6 && len(nets) < 64 {
+		if data[0]%2 == 0 {
+			ip := net.IP(append([]byte(nil), data[1:5]...))
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(data[5]%33), 32)})
+		} else {
+			ip := make(net.IP, 16)
+			copy(ip, data[1:5])
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(data[5]%129), 128)})
+		}
+		data = data[6:]
+	}
+	for _, n := range nets {
+		n.IP = n.IP.Mask(n.Mask)
+	}
+	return nets
+}
+
+func fuzzIPSet(nets []*net.IPNet) *ipSet {
+	s := &ipSet{name: "fuzz"}
+	for _, n := range nets {
+		s.addIPNet(n)
+	}
+	s.normalize()
+	return s
+}
+
+func naiveContains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzProbes 返回每个网段的首尾地址及其前后相邻的地址
+func fuzzProbes(nets []*net.IPNet) []net.IP {
+	probes := []net.IP{net.ParseIP("0.0.0.0"), net.ParseIP("255.255.255.255"), net.ParseIP("::"), net.ParseIP("::1")}
+	for _, n := range nets {
+		if ip4 := n.IP.To4(); ip4 != nil {
+			first := ipToUint32(ip4)
+			last := first | ^ipToUint32(net.IP(n.Mask))
+			for _, v := range []uint32{first, last, first - 1, last + 1} {
+				probes = append(probes, uint32ToIP(v))
+			}
+			continue
+		}
+		first := [16]byte(n.IP.To16())
+		var last [16]byte
+		for i := range last {
+			last[i] = first[i] | ^n.Mask[i]
+		}
+		before, _ := v6Family.prev(first)
+		after, _ := v6Family.next(last)
+		for _, v := range [][16]byte{first, last, before, after} {
+			probes = append(probes, net.IP(append([]byte(nil), v[:]...)))
+		}
+	}
+	return probes
+}
+
+func checkNormalized(t *testing.T, s *ipSet) {
+	t.Helper()
+	for i := 1; i < len(s.v4); i++ {
+		if s.v4[i-1].end == ^uint32(0) || s.v4[i].start <= s.v4[i-1].end+1 {
+			t.Fatalf("v4 table not normalized: %v", s.v4)
+		}
+	}
+	for i := 1; i < len(s.v6); i++ {
+		next, ok := v6Family.next(s.v6[i-1].end)
+		if !ok || compare16(s.v6[i].start, next) <= 0 {
+			t.Fatalf("v6 table not normalized: %v", s.v6)
+		}
+	}
+}
+
+func FuzzIPSetContains(f *testing.F) {
+	f.Add([]byte{0, 10, 0, 0, 0, 8, 0, 10, 1, 0, 0, 16, 0, 10, 128, 0, 0, 9})
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 1, 2, 3, 4, 32, 0, 100, 0, 0, 0, 24})
+	f.Add([]byte{1, 0x20, 0x01, 0x0d, 0xb8, 32, 1, 0x20, 0x01, 0x0d, 0xb8, 48, 1, 0xff, 0xff, 0, 0, 16})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		nets := fuzzCIDRs(data)
+		s := fuzzIPSet(nets)
+		checkNormalized(t, s)
+		for _, ip := range fuzzProbes(nets) {
+			if got, want := s.contains(ip), naiveContains(nets, ip); got != want {
+				t.Fatalf("contains(%s) = %v, want %v (nets %v)", ip, got, want, nets)
+			}
+		}
+	})
+}
+
+func FuzzIPSetOperations(f *testing.F) {
+	f.Add([]byte{0, 10, 0, 0, 0, 8}, []byte{0, 10, 1, 0, 0, 16, 0, 11, 0, 0, 0, 8})
+	f.Add([]byte{0, 0, 0, 0, 0, 0}, []byte{0, 255, 255, 255, 255, 32, 0, 0, 0, 0, 0, 32})
+	f.Add([]byte{1, 0x20, 0x01, 0x0d, 0xb8, 32}, []byte{1, 0x20, 0x01, 0x0d, 0xb8, 48, 1, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, da, db []byte) {
+		netsA, netsB := fuzzCIDRs(da), fuzzCIDRs(db)
+		a, b := fuzzIPSet(netsA), fuzzIPSet(netsB)
+		union, inter, diff := a.union(b), a.intersect(b), a.difference(b)
+		for _, s := range []*ipSet{union, inter, diff} {
+			checkNormalized(t, s)
+		}
+		for _, ip := range fuzzProbes(append(netsA, netsB...)) {
+			inA, inB := naiveContains(netsA, ip), naiveContains(netsB, ip)
+			if union.contains(ip) != (inA || inB) {
+				t.Fatalf("union contains(%s) wrong", ip)
+			}
+			if inter.contains(ip) != (inA && inB) {
+				t.Fatalf("intersect contains(%s) wrong", ip)
+			}
+			if diff.contains(ip) != (inA && !inB) {
+				t.Fatalf("difference contains(%s) wrong", ip)
+			}
+		}
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// IPSetConfig 定义一个具名 IP 集合，规则通过 "IP-SET,<name>,ACTION" 引用
+type IPSetConfig struct {
+	Name        string           `yaml:"name" json:"name"`
+	Source      string           `yaml:"source,omitempty" json:"source,omitempty"`   // 本地文件或 http(s) 地址，一行一个 CIDR 或 IP
+	CIDRs       []string         `yaml:"cidrs,omitempty" json:"cidrs,omitempty"`     // 直接写在配置里的网段
+	Refresh     string           `yaml:"refresh,omitempty" json:"refresh,omitempty"` // 远程数据源的缓存有效期，如 "24h"，默认 7 天
+	Verify      VerifyConfig     `yaml:"verify,omitempty" json:"verify,omitempty"`
+	FetchConfig `yaml:",inline"` // 远程数据源的 via、mirrors 等下载方式
+
+	// 并入或排除其他集合，只能引用内置集合和排在前面的集合
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// 内置集合：cn 由 china_ips 加载，lan 为局域网和回环地址
+const (
+	ipSetChina = "cn"
+	ipSetLAN   = "lan"
+)
+
+var lanCIDRs = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// ipSet 是一个具名 IP 集合，区间表规范化（排序并合并）后二分查找
+type ipSet struct {
+	name   string
+	source string
+	v4     []IPv4Range
+	v6     []IPv6Range
+}
+
+// ipSets 保存当前的集合表。集合建好后不再修改，更新时复制一份新表原子替换，读取不加锁
+var (
+	ipSets      atomic.Pointer[map[string]*ipSet]
+	ipSetsMutex sync.Mutex // 串行化更新
+	ipSetsGen   uint64     // 每次整体重建开始时加一，持有 ipSetsMutex 时访问
+)
+
+func (s *ipSet) addIPNet(ipnet *net.IPNet) {
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		start := ipToUint32(ip4)
+		mask := binary.BigEndian.Uint32(ipnet.Mask)
+		s.v4 = append(s.v4, IPv4Range{start, start | ^mask})
+		return
+	}
+	ip16 := ipnet.IP.To16()
+	if ip16 == nil {
+		return
+	}
+	var startArr, endArr, maskArr [16]byte
+	copy(startArr[:], ip16)
+	copy(maskArr[:], ipnet.Mask)
+	for i := 0; i < 16; i++ {
+		endArr[i] = startArr[i] | ^maskArr[i]
+	}
+	s.v6 = append(s.v6, IPv6Range{startArr, endArr})
+}
+
+// addLine 加入一行 CIDR 或单个 IP
+func (s *ipSet) addLine(line string) error {
+	if !strings.Contains(line, "/") {
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return fmt.Errorf("invalid IP")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		s.addIPNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(line)
+	if err != nil {
+		return err
+	}
+	s.addIPNet(ipnet)
+	return nil
+}
+
+// normalize 合并重叠和相邻的网段，查询前必须调用
+func (s *ipSet) normalize() {
+	s.v4 = v4Family.normalize(s.v4)
+	s.v6 = v6Family.normalize(s.v6)
+}
+
+func (s *ipSet) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return v4Family.contains(s.v4, ipToUint32(ip4))
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	return v6Family.contains(s.v6, [16]byte(ip16))
+}
+
+// union、intersect 和 difference 返回新的集合，参数必须已规范化
+func (s *ipSet) union(o *ipSet) *ipSet {
+	return &ipSet{name: s.name, source: s.source, v4: v4Family.union(s.v4, o.v4), v6: v6Family.union(s.v6, o.v6)}
+}
+
+func (s *ipSet) intersect(o *ipSet) *ipSet {
+	return &ipSet{name: s.name, source: s.source, v4: v4Family.intersect(s.v4, o.v4), v6: v6Family.intersect(s.v6, o.v6)}
+}
+
+func (s *ipSet) difference(o *ipSet) *ipSet {
+	return &ipSet{name: s.name, source: s.source, v4: v4Family.difference(s.v4, o.v4), v6: v6Family.difference(s.v6, o.v6)}
+}
+
+// parseIPSet 读取一行一个 CIDR 或 IP 的列表，空行和 # 注释被忽略，无效行记录日志后跳过
+func parseIPSet(name string, r io.Reader) (*ipSet, error) {
+	s, _, err := scanIPSet(name, r)
+	return s, err
+}
+
+// scanIPSet 和 parseIPSet 相同，另外返回有效行数
+func scanIPSet(name string, r io.Reader) (*ipSet, int, error) {
+	s := &ipSet{name: name}
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.addLine(line); err != nil {
+			log.Printf("Skipping invalid CIDR %q in IP set %s: %v", line, name, err)
+			continue
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.normalize()
+	return s, n, nil
+}
+
+// countIPSetEntries 统计列表中有效的 CIDR / IP 行数，用于校验下载内容。
+// 按行计数而不是按合并后的网段数，相邻网段较多的列表不会被 min_entries 误拒
+func countIPSetEntries(body []byte) (int, error) {
+	_, n, err := scanIPSet("download", bytes.NewReader(body))
+	return n, err
+}
+
+func ipSetValidator(c IPSetConfig) sourceValidator {
+	return newSourceValidator(c.Verify, countIPSetEntries)
+}
+
+func loadIPSetFromFile(name, filename string) (*ipSet, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseIPSet(name, file)
+}
+
+func newLANIPSet() *ipSet {
+	s := &ipSet{name: ipSetLAN, source: "builtin"}
+	for _, cidr := range lanCIDRs {
+		s.addLine(cidr)
+	}
+	s.normalize()
+	return s
+}
+
+// loadIPSet 按配置加载一个集合：合并 source、cidrs 和 include 中的集合，再去掉 exclude 中的集合。
+// include/exclude 从 sets 中查找
+func loadIPSet(c IPSetConfig, sets map[string]*ipSet) (*ipSet, error) {
+	maxAge, err := parseCacheMaxAge(c.Refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ipSet{name: c.Name}
+	if c.Source != "" {
+		path, err := fetchCached(c.Source, maxAge, c.FetchConfig, ipSetValidator(c))
+		if err != nil {
+			return nil, err
+		}
+		if s, err = loadIPSetFromFile(c.Name, path); err != nil {
+			return nil, err
+		}
+		s.source = c.Source
+	} else {
+		s.source = "config"
+	}
+	for _, cidr := range c.CIDRs {
+		if err := s.addLine(strings.TrimSpace(cidr)); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+	}
+	s.normalize()
+	for _, name := range c.Include {
+		o := sets[name]
+		if o == nil {
+			return nil, fmt.Errorf("included IP set %s not loaded", name)
+		}
+		s = s.union(o)
+	}
+	for _, name := range c.Exclude {
+		o := sets[name]
+		if o == nil {
+			return nil, fmt.Errorf("excluded IP set %s not loaded", name)
+		}
+		s = s.difference(o)
+	}
+	return s, nil
+}
+
+// setIPSet 加入或替换一个集合
+func setIPSet(s *ipSet) {
+	ipSetsMutex.Lock()
+	defer ipSetsMutex.Unlock()
+	m := make(map[string]*ipSet)
+	if old := ipSets.Load(); old != nil {
+		maps.Copy(m, *old)
+	}
+	m[s.name] = s
+	ipSets.Store(&m)
+}
+
+func getIPSet(name string) *ipSet {
+	if m := ipSets.Load(); m != nil {
+		return (*m)[name]
+	}
+	return nil
+}
+
+// ipSetContains 判断 IP 是否属于指定集合，集合不存在（未配置或加载失败）时返回 false
+func ipSetContains(name string, ip net.IP) bool {
+	s := getIPSet(name)
+	return s != nil && s.contains(ip)
+}
+
+// isIPSetName 判断名称是否为内置或已配置的 IP 集合
+func isIPSetName(name string) bool {
+	if name == ipSetChina || name == ipSetLAN {
+		return true
+	}
+	for _, c := range config.IPSets {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InitIPSets 加载 ip_sets 中的集合并重建 lan 集合。加载失败的集合保留上一次的内容；
+// cn 由 InitChinaIPs 加载，china_ips 为空时移除
+func InitIPSets() {
+	configMutex.RLock()
+	chinaIPs, configs := config.ChinaIps, config.IPSets
+	configMutex.RUnlock()
+
+	// 下载和解析不持锁；替换前已有更晚开始的重建（刷新协程和 /api/config 并发）时
+	// 丢弃本次结果，旧配置建出的表不会覆盖新表
+	ipSetsMutex.Lock()
+	ipSetsGen++
+	gen := ipSetsGen
+	ipSetsMutex.Unlock()
+
+	loaded := map[string]*ipSet{ipSetLAN: newLANIPSet()}
+	if s := getIPSet(ipSetChina); s != nil && chinaIPs != "" {
+		loaded[ipSetChina] = s
+	}
+	for _, c := range configs {
+		if c.Name == "" || c.Name == ipSetChina || c.Name == ipSetLAN {
+			log.Printf("Skipping IP set with reserved or empty name %q", c.Name)
+			continue
+		}
+		s, err := loadIPSet(c, loaded)
+		if err != nil {
+			log.Printf("❌ Failed to load IP set %s: %v", c.Name, err)
+			if old := getIPSet(c.Name); old != nil {
+				loaded[c.Name] = old
+			}
+			continue
+		}
+		loaded[c.Name] = s
+		log.Printf("✔ Loaded IP set %s (%d IPv4, %d IPv6 ranges)", c.Name, len(s.v4), len(s.v6))
+	}
+
+	ipSetsMutex.Lock()
+	defer ipSetsMutex.Unlock()
+	if gen != ipSetsGen {
+		return
+	}
+	ipSets.Store(&loaded)
+}
+
+// IPSetInfo 是 /api/ipsets 返回的集合概况
+type IPSetInfo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	IPv4   int    `json:"ipv4_ranges"`
+	IPv6   int    `json:"ipv6_ranges"`
+}
+
+func listIPSets() []IPSetInfo {
+	var sets map[string]*ipSet
+	if m := ipSets.Load(); m != nil {
+		sets = *m
+	}
+	list := make([]IPSetInfo, 0, len(sets))
+	for _, s := range sets {
+		list = append(list, IPSetInfo{Name: s.name, Source: s.source, IPv4: len(s.v4), IPv6: len(s.v6)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIPSet(t *testing.T) {
+	s, err := parseIPSet("test", strings.NewReader("# 注释\n\n203.0.113.0/24\n198.51.100.7\n2001:db8::/32\nnot-an-ip\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"203.0.113.200": true,
+		"198.51.100.7":  true,
+		"198.51.100.8":  false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+	}
+	for ip, want := range cases {
+		if got := s.contains(net.ParseIP(ip)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+// useTestIPSets 使用给定的 ip_sets 配置加载集合，测试结束后恢复
+func useTestIPSets(t *testing.T, sets []IPSetConfig) {
+	t.Helper()
+	useTestChinaRanges(t, "1.2.0.0/16")
+	config.ChinaIps = "cn.txt" // 只用于让 InitIPSets 保留 cn 集合
+	config.IPSets = sets
+	InitIPSets()
+	t.Cleanup(func() { config.ChinaIps, config.IPSets = "", nil })
+}
+
+func TestIPSetRules(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(blocklist, []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	useTestIPSets(t, []IPSetConfig{
+		{Name: "blocklist", Source: blocklist},
+		{Name: "company-vpn", CIDRs: []string{"100.64.0.0/10"}},
+	})
+
+	rules := compileRules([]string{
+		"IP-SET,blocklist,REJECT",
+		"IP-SET,company-vpn,DIRECT,no-resolve",
+		"IP-SET,lan,DIRECT",
+		"IP-SET,missing,PROXY",
+		"MATCH,PROXY",
+	})
+	if len(rules) != 4 {
+		t.Fatalf("compiled %d rules, want the unknown IP set skipped", len(rules))
+	}
+	cases := map[string]string{
+		"203.0.113.9:443": ActionReject,
+		"100.64.1.1:22":   ActionDirect,
+		"192.168.1.1:80":  ActionDirect,
+		"1.2.3.4:80":      ActionProxy, // cn 没有被规则引用
+	}
+	for target, want := range cases {
+		if got, _ := matchRuleList(rules, target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+	if !isIPInRanges(net.ParseIP("1.2.3.4")) || isIPInRanges(net.ParseIP("203.0.113.9")) {
+		t.Error("china_ips check must only use the cn and lan sets")
+	}
+}
+
+func TestIPSetIncludeExclude(t *testing.T) {
+	useTestIPSets(t, []IPSetConfig{
+		{Name: "company-vpn", CIDRs: []string{"100.64.0.0/10"}},
+		{Name: "blocked", CIDRs: []string{"1.2.3.0/24", "192.168.9.0/24"}},
+		{Name: "direct", Include: []string{"cn", "lan", "company-vpn"}, Exclude: []string{"blocked"}},
+		{Name: "broken", Include: []string{"later"}},
+		{Name: "later", CIDRs: []string{"5.5.5.0/24"}},
+	})
+	cases := map[string]bool{
+		"1.2.4.4":     true,
+		"1.2.3.4":     false,
+		"192.168.1.1": true,
+		"192.168.9.1": false,
+		"100.64.0.1":  true,
+		"8.8.8.8":     false,
+	}
+	for ip, want := range cases {
+		if got := ipSetContains("direct", net.ParseIP(ip)); got != want {
+			t.Errorf("direct contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if getIPSet("broken") != nil {
+		t.Error("IP set including a set defined later was loaded")
+	}
+}
+
+func TestInitIPSetsKeepsPreviousOnFailure(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "vpn.txt")
+	os.WriteFile(source, []byte("100.64.0.0/10\n"), 0644)
+	useTestIPSets(t, []IPSetConfig{{Name: "company-vpn", Source: source}})
+
+	// 数据源消失后保留上一次加载的内容，cn 集合也保持不变
+	os.Remove(source)
+	InitIPSets()
+	if !ipSetContains("company-vpn", net.ParseIP("100.64.0.1")) {
+		t.Error("IP set dropped after a failed reload")
+	}
+	if !ipSetContains(ipSetChina, net.ParseIP("1.2.3.4")) {
+		t.Error("cn set dropped by InitIPSets")
+	}
+
+	// 从配置中移除后集合也被移除
+	config.IPSets = nil
+	InitIPSets()
+	if getIPSet("company-vpn") != nil {
+		t.Error("removed IP set still registered")
+	}
+}
+
+func TestIPSetsAPI(t *testing.T) {
+	useTestIPSets(t, []IPSetConfig{{Name: "company-vpn", CIDRs: []string{"100.64.0.0/10", "fd00:1::/64"}}})
+
+	rec := httptest.NewRecorder()
+	ipSetsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/ipsets", nil))
+	var list []IPSetInfo
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[1].Name != "company-vpn" || list[1].IPv4 != 1 || list[1].IPv6 != 1 {
+		t.Fatalf("list = %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	ipSetsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/ipsets?name=company-vpn&ip=100.64.0.1", nil))
+	var result struct{ Contains bool }
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || !result.Contains {
+		t.Fatalf("membership query: %v, %+v", err, result)
+	}
+
+	rec = httptest.NewRecorder()
+	ipSetsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/ipsets?name=nope&ip=1.1.1.1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown set: status %d", rec.Code)
+	}
+}
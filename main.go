@@ -2,26 +2,32 @@ package main
 
 import (
 	"log"
-	"strings"
+	"os"
 )
 
-var currentListenAddr string
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
 	if err := loadConfig(); err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 	InitChinaIPs()
-
-	currentListenAddr = getListenAddr(config)
+	InitIPSets()
+	InitDomainSets()
+	InitGeoIPDB()
+	InitResolver()
+	InitUpstreams()
+	InitRules()
 
 	UpdateTray(StatusStarting)
 
 	go startConfigWebServer()
+	go refreshRemoteListsPeriodically()
 	go startTray()
 	go startProxy()
 
-	if strings.ToLower(config.LocalMode) != "socks5" && config.EnableWindowsProxy {
+	if _, ok := systemProxyPort(); ok && config.EnableWindowsProxy {
 		go EnableSystemProxy()
 		go EnableBypassList()
 	} else {
@@ -38,22 +44,7 @@ func main() {
 	}
 }
 
+// startProxy 按配置启动、停止或更新各个入口，未改变的入口不受影响
 func startProxy() {
-	closePreviousListener()
-
-	addr := getListenAddr(config)
-	currentListenAddr = addr
-
-	mode := strings.ToLower(config.LocalMode)
-	switch mode {
-	case "http":
-		UpdateTray(StatusRunningHTTP)
-		startHTTPProxy()
-	case "socks5":
-		UpdateTray(StatusRunningSocks5)
-		startSocks5Proxy()
-	default:
-		UpdateTray(StatusError)
-		log.Printf("Unsupported local_mode: %s", config.LocalMode)
-	}
+	applyInbounds(inboundConfigs(config))
 }
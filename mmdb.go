@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 纯 Go 的 MaxMind DB (MMDB) 读取器，只实现按 IP 查询所需的部分，
+// 格式参见 https://maxmind.github.io/MaxMind-DB/
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbMaxDepth 限制数据段中 map/array 的嵌套深度，防止损坏的文件导致无限递归
+const mmdbMaxDepth = 32
+
+type mmdbReader struct {
+	tree         []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint // IPv6 库中 ::/96 对应的节点，IPv4 地址从这里开始查找
+	databaseType string
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("not an MMDB file: metadata marker not found")
+	}
+	v, _, err := (&mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MMDB metadata: %v", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid MMDB metadata: not a map")
+	}
+
+	r := &mmdbReader{
+		nodeCount:  mmdbUint(meta["node_count"]),
+		recordSize: mmdbUint(meta["record_size"]),
+		ipVersion:  mmdbUint(meta["ip_version"]),
+	}
+	r.databaseType, _ = meta["database_type"].(string)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported MMDB record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MMDB IP version %d", r.ipVersion)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("MMDB search tree exceeds file size")
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for bit := 0; bit < 96 && node < r.nodeCount; bit++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// readNode 读取节点的左（bit=0）或右（bit=1）记录
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := r.tree[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.tree[off : off+4]))
+	}
+}
+
+// lookup 返回 IP 对应的记录，没有记录时返回 nil
+func (r *mmdbReader) lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		if addr = ip.To16(); addr == nil {
+			return nil, fmt.Errorf("invalid IP %v", ip)
+		}
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		node = r.readNode(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("MMDB search tree is truncated")
+	}
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("MMDB record pointer out of range")
+	}
+	v, _, err := (&mmdbDecoder{buf: r.data}).decode(offset, 0)
+	return v, err
+}
+
+// country 返回 IP 所属国家的 ISO 代码（大写），查不到时返回空字符串
+func (r *mmdbReader) country(ip net.IP) string {
+	v, err := r.lookup(ip)
+	if err != nil {
+		log.Printf("GeoIP lookup for %s failed: %v", ip, err)
+		return ""
+	}
+	record, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+// mmdbDecoder 解码 MMDB 数据段，指针相对于 buf 起始位置
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) take(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.buf)) || off+n < off {
+		return nil, fmt.Errorf("unexpected end of MMDB data")
+	}
+	return d.buf[off : off+n], nil
+}
+
+// decode 解码 off 处的一个值，返回值和下一个值的位置
+func (d *mmdbDecoder) decode(off uint, depth int) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("MMDB data nested too deeply")
+	}
+	b, err := d.take(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // 指针
+		size := uint(ctrl>>3) & 0x3
+		p, err := d.take(off, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch size {
+		case 0:
+			ptr = uint(ctrl&0x7)<<8 | uint(p[0])
+		case 1:
+			ptr = (uint(ctrl&0x7)<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 2:
+			ptr = (uint(ctrl&0x7)<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		case 3:
+			ptr = uint(binary.BigEndian.Uint32(p))
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, off + size + 1, err
+	}
+
+	if typ == 0 { // 扩展类型
+		ext, err := d.take(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(ext[0])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		ext, err := d.take(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + uint(ext[0])
+		case 2:
+			size = 285 + (uint(ext[0])<<8 | uint(ext[1]))
+		case 3:
+			size = 65821 + (uint(ext[0])<<16 | uint(ext[1])<<8 | uint(ext[2]))
+		}
+	}
+
+	switch typ {
+	case 2: // UTF-8 字符串
+		s, err := d.take(off, size)
+		return string(s), off + size, err
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid MMDB double size %d", size)
+		}
+		v, err := d.take(off, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), off + 8, nil
+	case 4: // bytes
+		v, err := d.take(off, size)
+		return append([]byte(nil), v...), off + size, err
+	case 5, 6, 9, 10: // uint16、uint32、uint64、uint128
+		v, err := d.take(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size > 8 {
+			return new(big.Int).SetBytes(v), off + size, nil
+		}
+		var n uint64
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		return n, off + size, nil
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("MMDB map key is not a string")
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 8: // int32
+		v, err := d.take(off, size)
+		if err != nil || size > 4 {
+			return nil, 0, fmt.Errorf("invalid MMDB int32")
+		}
+		var n uint32
+		for _, c := range v {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), off + size, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean，值在 size 中
+		return size != 0, off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid MMDB float size %d", size)
+		}
+		v, err := d.take(off, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(v)), off + 4, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MMDB data type %d", typ)
+}
+
+// mmdbUint 把解码出的无符号整数转换为 uint
+func mmdbUint(v any) uint {
+	if n, ok := v.(uint64); ok {
+		return uint(n)
+	}
+	return 0
+}
+
+// ------------------ GeoIP 数据库 ------------------
+
+var (
+	geoIPDB    *mmdbReader // 为 nil 时 GEOIP 只能使用 china_ips
+	geoIPMutex sync.RWMutex
+)
+
+// InitGeoIPDB 加载 geoip_db 指定的 MMDB 文件（本地路径或 http(s) 地址）
+func InitGeoIPDB() {
+	var db *mmdbReader
+	if src := config.GeoIPDB; src != "" {
+		maxAge, err := parseCacheMaxAge(config.GeoIPDBSource.Refresh)
+		var path string
+		if err == nil {
+			path, err = fetchCached(src, maxAge, config.GeoIPDBSource.FetchConfig, geoIPValidator())
+		}
+		if err == nil {
+			db, err = openMMDB(path)
+		}
+		if err != nil {
+			log.Printf("❌ Failed to load GeoIP database %s: %v", src, err)
+		} else {
+			log.Printf("✔ Loaded GeoIP database %s (%s)", src, db.databaseType)
+		}
+	}
+	geoIPMutex.Lock()
+	geoIPDB = db
+	geoIPMutex.Unlock()
+}
+
+// geoIPValidator 校验下载的 MMDB 文件能够打开，条目数按搜索树的节点数计
+func geoIPValidator() sourceValidator {
+	return newSourceValidator(config.GeoIPDBSource.Verify, func(body []byte) (int, error) {
+		db, err := newMMDBReader(body)
+		if err != nil {
+			return 0, err
+		}
+		return int(db.nodeCount), nil
+	})
+}
+
+// geoIPCountry 返回 IP 所属国家代码，没有加载 MMDB 或查不到时返回空字符串
+func geoIPCountry(ip net.IP) string {
+	geoIPMutex.RLock()
+	db := geoIPDB
+	geoIPMutex.RUnlock()
+	if db == nil {
+		return ""
+	}
+	return db.country(ip)
+}
+
+// geoIPMatch 判断 IP 是否属于国家 cc。MMDB 中查不到的地址（例如局域网）对 CN 回退到 china_ips
+func geoIPMatch(ip net.IP, cc string) bool {
+	if country := geoIPCountry(ip); country != "" {
+		return country == cc
+	}
+	return cc == "CN" && isIPInRanges(ip)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbTestPointer 在测试数据中表示一个指向数据段偏移的指针
+type mmdbTestPointer uint
+
+// encodeTestMMDB 按 MMDB 数据段格式编码测试用的值，只支持较短的长度
+func encodeTestMMDB(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint16:
+		return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+	case uint32:
+		return binary.BigEndian.AppendUint32([]byte{6<<5 | 4}, v)
+	case mmdbTestPointer:
+		return []byte{1<<5 | byte(v>>8)&0x7, byte(v)}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := []byte{7<<5 | byte(len(v))}
+		for _, k := range keys {
+			b = append(b, encodeTestMMDB(k)...)
+			b = append(b, encodeTestMMDB(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported test value")
+}
+
+type testMMDBNode struct {
+	children [2]*testMMDBNode
+	leaf     bool
+	offset   uint
+}
+
+// buildTestMMDB 生成一个 IPv6 树的 MMDB 文件，IPv4 网段放在 ::/96 之下
+func buildTestMMDB(t *testing.T, recordSize uint, networks map[string]uint, data []byte) []byte {
+	t.Helper()
+	root := &testMMDBNode{}
+	for cidr, offset := range networks {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		addr := ipnet.IP.To16()
+		if ipnet.IP.To4() != nil {
+			addr = append(make([]byte, 12), ipnet.IP.To4()...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				node.children[bit] = &testMMDBNode{leaf: true, offset: offset}
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &testMMDBNode{}
+			}
+			node = node.children[bit]
+		}
+	}
+
+	// 按广度优先给内部节点编号
+	var nodes []*testMMDBNode
+	index := make(map[*testMMDBNode]uint)
+	for queue := []*testMMDBNode{root}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		index[n] = uint(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && !c.leaf {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+	record := func(c *testMMDBNode) uint {
+		switch {
+		case c == nil:
+			return nodeCount
+		case c.leaf:
+			return nodeCount + 16 + c.offset
+		}
+		return index[c]
+	}
+
+	var tree []byte
+	for _, n := range nodes {
+		left, right := record(n.children[0]), record(n.children[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(left>>24)<<4|byte(right>>24),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(tree, uint32(left))
+			tree = binary.BigEndian.AppendUint32(tree, uint32(right))
+		}
+	}
+
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, encodeTestMMDB(map[string]any{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(6),
+		"database_type": "Test-Country",
+	})...)
+}
+
+// testCountryDB 返回包含 CN、US（经指针引用的 registered_country）和 JP（IPv6）的测试库
+func testCountryDB(t *testing.T, recordSize uint) []byte {
+	cn := encodeTestMMDB(map[string]any{"country": map[string]any{"iso_code": "CN"}})
+	usCountry := uint(len(cn))
+	us := encodeTestMMDB(map[string]any{"iso_code": "US"})
+	usRecord := usCountry + uint(len(us))
+	usRef := encodeTestMMDB(map[string]any{"registered_country": mmdbTestPointer(usCountry)})
+	jpRecord := usRecord + uint(len(usRef))
+	jp := encodeTestMMDB(map[string]any{"country": map[string]any{"iso_code": "jp"}})
+
+	data := append(append(append(append([]byte(nil), cn...), us...), usRef...), jp...)
+	return buildTestMMDB(t, recordSize, map[string]uint{
+		"1.2.0.0/16":    0,
+		"8.8.8.0/24":    usRecord,
+		"2001:db8::/32": jpRecord,
+	}, data)
+}
+
+func TestMMDBCountryLookup(t *testing.T) {
+	for _, size := range []uint{24, 28, 32} {
+		db, err := newMMDBReader(testCountryDB(t, size))
+		if err != nil {
+			t.Fatalf("record size %d: %v", size, err)
+		}
+		cases := map[string]string{
+			"1.2.3.4":     "CN",
+			"8.8.8.8":     "US",
+			"2001:db8::1": "JP",
+			"9.9.9.9":     "",
+			"2001:db9::1": "",
+		}
+		for ip, want := range cases {
+			if got := db.country(net.ParseIP(ip)); got != want {
+				t.Errorf("record size %d: country(%s) = %q, want %q", size, ip, got, want)
+			}
+		}
+	}
+}
+
+func TestMMDBRejectsCorruptFiles(t *testing.T) {
+	buf := testCountryDB(t, 24)
+	if _, err := newMMDBReader(buf[:len(buf)/2]); err == nil {
+		t.Error("file without metadata accepted")
+	}
+	db, err := newMMDBReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 把 1.2.0.0/16 记录的第一个字节改成指向数据段之外的指针
+	db.data[0] = 1<<5 | 0x7
+	if _, err := db.lookup(net.ParseIP("1.2.3.4")); err == nil {
+		t.Error("dangling pointer decoded without error")
+	}
+}
+
+func TestGeoIPRuleUsesMMDB(t *testing.T) {
+	useTestChinaRanges(t)
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, testCountryDB(t, 24), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.GeoIPDB = path
+	InitGeoIPDB()
+	defer func() {
+		config.GeoIPDB = ""
+		InitGeoIPDB()
+	}()
+
+	rules := compileRules([]string{"GEOIP,us,PROXY", "GEOIP,CN,DIRECT", "GEOIP,China,DIRECT", "MATCH,REJECT"})
+	if len(rules) != 3 {
+		t.Fatalf("compiled %d rules, want the invalid country code skipped", len(rules))
+	}
+	cases := map[string]string{
+		"8.8.8.8:53":     ActionProxy,
+		"1.2.3.4:80":     ActionDirect,
+		"192.168.1.1:80": ActionDirect, // MMDB 中没有，CN 回退到 china_ips（含局域网）
+		"9.9.9.9:80":     ActionReject,
+	}
+	for target, want := range cases {
+		if got, _ := matchRuleList(rules, target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+}
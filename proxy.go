@@ -1,52 +1,263 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
-var currentListener net.Listener
-var listenerMutex sync.Mutex
+// 监听注册表，按名称管理所有正在运行的入口
+var (
+	inbounds      = make(map[string]*inbound)
+	inboundsMutex sync.Mutex
+	applyMutex    sync.Mutex // 串行化 applyInbounds
+)
 
-func closePreviousListener() {
-	listenerMutex.Lock()
-	defer listenerMutex.Unlock()
-	if currentListener != nil {
-		_ = currentListener.Close()
-		currentListener = nil
-		log.Println("🔌 Previous listener closed")
+// inboundConfigs 返回配置中的入口列表，未配置 inbounds 时使用旧的 local_mode/listen_on/listen_port
+func inboundConfigs(cfg Config) []InboundConfig {
+	var cfgs []InboundConfig
+	if len(cfg.Inbounds) > 0 {
+		cfgs = append(cfgs, cfg.Inbounds...)
+	} else {
+		cfgs = []InboundConfig{{
+			Name:     "default",
+			Protocol: cfg.LocalMode,
+			Listen:   cfg.ListenOn,
+			Port:     cfg.ListenPort,
+		}}
+	}
+	for i := range cfgs {
+		if cfgs[i].Name == "" {
+			cfgs[i].Name = fmt.Sprintf("%s@%s", cfgs[i].protocol(), cfgs[i].addr())
+		}
 	}
+	return cfgs
 }
 
-func startHTTPProxy() {
-	addr := fmt.Sprintf("%s:%d", config.ListenOn, config.ListenPort)
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("HTTP proxy failed to listen: %v", err)
+// applyInbounds 让注册表与配置一致：停止被删除或地址改变的入口，启动新入口，
+// 其余入口只原地更新认证和规则，已有连接不受影响
+func applyInbounds(cfgs []InboundConfig) {
+	applyMutex.Lock()
+	defer applyMutex.Unlock()
+
+	wanted := make(map[string]InboundConfig)
+	var unique []InboundConfig
+	for _, c := range cfgs {
+		if _, dup := wanted[c.Name]; dup {
+			log.Printf("Skipping duplicate inbound %s", c.Name)
+			continue
+		}
+		wanted[c.Name] = c
+		unique = append(unique, c)
+	}
+
+	inboundsMutex.Lock()
+	var stale []string
+	for name, in := range inbounds {
+		if c, ok := wanted[name]; !ok || !c.sameListener(in.cfg) {
+			stale = append(stale, name)
+		}
+	}
+	inboundsMutex.Unlock()
+	for _, name := range stale {
+		stopInbound(name)
 	}
-	log.Printf("Starting HTTP proxy on %s", addr)
 
-	listenerMutex.Lock()
-	currentListener = ln
-	listenerMutex.Unlock()
+	for _, c := range unique {
+		inboundsMutex.Lock()
+		in, running := inbounds[c.Name]
+		inboundsMutex.Unlock()
+		if running {
+			in.update(c)
+			continue
+		}
+		if err := startInbound(c); err != nil {
+			log.Printf("❌ %v", err)
+		}
+	}
+	updateTrayForInbounds()
+}
+
+// startInbound 打开监听并注册，连接在后台处理
+func startInbound(c InboundConfig) error {
+	switch c.protocol() {
+	case "http", "socks5", "socks4", "socks", "mixed", "dns", "redirect", "tproxy":
+	default:
+		return fmt.Errorf("inbound %s: unsupported protocol %q", c.Name, c.Protocol)
+	}
 
-	http.Serve(ln, http.HandlerFunc(httpProxyHandler))
+	inboundsMutex.Lock()
+	defer inboundsMutex.Unlock()
+	if _, running := inbounds[c.Name]; running {
+		return fmt.Errorf("inbound %s is already running", c.Name)
+	}
+	ln, pc, err := listenInbound(c)
+	if err != nil {
+		return fmt.Errorf("inbound %s failed to listen on %s: %v", c.Name, c.addr(), err)
+	}
+	in := newInbound(c, ln)
+	in.pc = pc
+	inbounds[c.Name] = in
+	log.Printf("Starting %s inbound %s on %s", c.protocol(), c.Name, ln.Addr())
+	go in.serve()
+	return nil
 }
 
-func startSocks5Proxy() {
-	addr := fmt.Sprintf("%s:%d", config.ListenOn, config.ListenPort)
-	ln, err := net.Listen("tcp", addr)
+// listenInbound 按协议打开监听：dns 和 tproxy 同时监听 UDP，端口为 0 时 UDP 使用 TCP 分配到的端口
+func listenInbound(c InboundConfig) (net.Listener, net.PacketConn, error) {
+	if c.protocol() == "tproxy" {
+		return listenTProxy(c.addr())
+	}
+	if c.protocol() == "redirect" && runtime.GOOS != "linux" {
+		return nil, nil, fmt.Errorf("redirect inbounds are only supported on Linux")
+	}
+	ln, err := net.Listen("tcp", c.addr())
 	if err != nil {
-		log.Fatalf("SOCKS5 proxy failed to listen: %v", err)
+		return nil, nil, err
+	}
+	if c.protocol() != "dns" {
+		return ln, nil, nil
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return ln, pc, nil
+}
+
+// stopInbound 关闭一个入口的监听，已建立的连接继续运行到结束
+func stopInbound(name string) error {
+	inboundsMutex.Lock()
+	in, ok := inbounds[name]
+	delete(inbounds, name)
+	inboundsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("inbound %s is not running", name)
+	}
+	_ = in.ln.Close()
+	if in.pc != nil {
+		_ = in.pc.Close()
+	}
+	log.Printf("🔌 Inbound %s closed", name)
+	return nil
+}
+
+// InboundStatus 是 API 返回的入口状态
+type InboundStatus struct {
+	InboundConfig
+	Running bool `json:"running"`
+}
+
+// listInbounds 返回配置中所有入口及其运行状态
+func listInbounds() []InboundStatus {
+	inboundsMutex.Lock()
+	defer inboundsMutex.Unlock()
+	var list []InboundStatus
+	for _, c := range inboundConfigs(config) {
+		_, running := inbounds[c.Name]
+		list = append(list, InboundStatus{InboundConfig: c, Running: running})
+	}
+	return list
+}
+
+// findInboundConfig 按名称查找配置中的入口
+func findInboundConfig(name string) (InboundConfig, bool) {
+	for _, c := range inboundConfigs(config) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return InboundConfig{}, false
+}
+
+// runningProtocols 返回正在运行的入口协议，按名称排序
+func runningProtocols() []string {
+	inboundsMutex.Lock()
+	defer inboundsMutex.Unlock()
+	names := make([]string, 0, len(inbounds))
+	for name := range inbounds {
+		names = append(names, name)
 	}
-	log.Printf("Starting SOCKS5 proxy on :%s", addr)
+	sort.Strings(names)
+	protocols := make([]string, 0, len(names))
+	for _, name := range names {
+		protocols = append(protocols, inbounds[name].cfg.protocol())
+	}
+	return protocols
+}
+
+func updateTrayForInbounds() {
+	protocols := runningProtocols()
+	switch {
+	case len(protocols) == 0:
+		UpdateTray(StatusError)
+	case len(protocols) > 1:
+		UpdateTray(StatusRunningMulti)
+	case protocols[0] == "http":
+		UpdateTray(StatusRunningHTTP)
+	case protocols[0] == "mixed":
+		UpdateTray(StatusRunningMixed)
+	case protocols[0] == "dns":
+		UpdateTray(StatusRunningDNS)
+	default:
+		UpdateTray(StatusRunningSocks5)
+	}
+}
+
+// systemProxyPort 返回 Windows 系统代理应指向的端口：第一个 HTTP 或 mixed 入口
+func systemProxyPort() (int, bool) {
+	for _, c := range inboundConfigs(config) {
+		if p := c.protocol(); p == "http" || p == "mixed" {
+			return c.Port, true
+		}
+	}
+	return 0, false
+}
+
+// serve 按协议处理入口上的连接，直到监听被关闭
+func (in *inbound) serve() {
+	switch in.cfg.protocol() {
+	case "http":
+		http.Serve(in.ln, httpProxyHandler(in))
+	case "mixed":
+		serveMixed(in.ln, in)
+	case "dns":
+		go serveDNSUDP(in.pc)
+		serveDNSTCP(in.ln)
+	case "redirect":
+		serveTransparent(in.ln, in, redirectOriginalDst)
+	case "tproxy":
+		go serveTProxyUDP(in.pc, in)
+		serveTransparent(in.ln, in, localAddrDst)
+	default:
+		serveSocks(in.ln, in)
+	}
+}
+
+// serveSocks 接受 SOCKS5/SOCKS4 连接
+func serveSocks(ln net.Listener, in *inbound) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Accept error:", err)
+			return
+		}
+		go handleSocks5Connection(conn, in)
+	}
+}
 
-	listenerMutex.Lock()
-	currentListener = ln
-	listenerMutex.Unlock()
+// serveMixed 在已打开的监听上接受连接并按协议分发
+func serveMixed(ln net.Listener, in *inbound) {
+	httpLn := newChanListener(ln.Addr())
+	defer httpLn.Close()
+	go http.Serve(httpLn, httpProxyHandler(in))
 
 	for {
 		conn, err := ln.Accept()
@@ -54,10 +265,69 @@ func startSocks5Proxy() {
 			log.Println("Accept error:", err)
 			return
 		}
-		go handleSocks5Connection(conn)
+		go dispatchMixedConn(conn, httpLn, in)
+	}
+}
+
+// dispatchMixedConn 偷看第一个字节：0x05/0x04 交给 SOCKS5/SOCKS4 处理，其余按 HTTP 处理
+func dispatchMixedConn(conn net.Conn, httpLn *chanListener, in *inbound) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(mixedPeekTimeout))
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	peeked := &bufferedConn{Conn: conn, r: br}
+	switch first[0] {
+	case 0x05, 0x04:
+		handleSocks5Connection(peeked, in)
+	default:
+		if !httpLn.push(peeked) {
+			conn.Close()
+		}
+	}
+}
+
+// mixedPeekTimeout 限制客户端发送第一个字节的等待时间
+const mixedPeekTimeout = 30 * time.Second
+
+// chanListener 是一个由外部推送连接的 net.Listener，用于把连接交给 http.Serve
+type chanListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *chanListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
 	}
 }
 
-func getListenAddr(cfg Config) string {
-	return fmt.Sprintf("%s:%d", cfg.ListenOn, cfg.ListenPort)
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
 }
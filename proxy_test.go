@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestMixedListener(t *testing.T) {
+	origin := newOriginServer(t)
+	config.Rules = []string{"MATCH,DIRECT"}
+	InitRules()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveMixed(ln, nil)
+	defer func() {
+		ln.Close()
+		config.Rules = nil
+		InitRules()
+	}()
+
+	socksDialer, _ := proxy.SOCKS5("tcp", ln.Addr().String(), nil, proxy.Direct)
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	clients := map[string]*http.Client{
+		"socks5": {Transport: &http.Transport{Dial: socksDialer.Dial}},
+		"http":   {Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}},
+	}
+	for name, client := range clients {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Errorf("%s: GET through mixed listener failed: %v", name, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello from origin" {
+			t.Errorf("%s: body = %q", name, body)
+		}
+	}
+}
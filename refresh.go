@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	listRefreshCheckInterval = time.Minute
+	listRefreshRetryDelay    = 10 * time.Minute // 下载失败后至少等待这么久再重试
+)
+
+// remoteList 是一个需要定期刷新的远程数据源，reload 在缓存文件更新后重新加载。
+// rebuildIPSets 表示更新后还要整体重建 IP 集合，同一轮刷新中只重建一次
+type remoteList struct {
+	name          string
+	source        string
+	refresh       string
+	fetch         FetchConfig
+	validate      sourceValidator
+	reload        func() error
+	rebuildIPSets bool
+}
+
+// remoteLists 返回配置中所有的远程数据源。刷新协程和 /api/config 并发，先在读锁下复制一份配置
+func remoteLists() []remoteList {
+	configMutex.RLock()
+	cfg := config
+	configMutex.RUnlock()
+
+	var lists []remoteList
+	if src := cfg.ChinaIps; src != "" {
+		// 重新计算 include/exclude 了 cn 的集合
+		lists = append(lists, remoteList{ipSetChina, src, cfg.ChinaIpsSource.Refresh, cfg.ChinaIpsSource.FetchConfig, chinaIPsValidator(), func() error {
+			return loadIPRangesCached(src)
+		}, true})
+	}
+	for _, c := range cfg.IPSets {
+		if c.Name == "" || c.Name == ipSetChina || c.Name == ipSetLAN {
+			continue
+		}
+		// 集合之间可能有 include/exclude 引用，整体重建；其余集合的缓存未过期，只会读取本地文件
+		lists = append(lists, remoteList{"ip set " + c.Name, c.Source, c.Refresh, c.FetchConfig, ipSetValidator(c), nil, true})
+	}
+	for _, c := range cfg.DomainSets {
+		if c.Name == "" {
+			continue
+		}
+		lists = append(lists, remoteList{"domain set " + c.Name, c.Source, c.Refresh, c.FetchConfig, domainSetValidator(c), func() error {
+			s, err := loadDomainSet(c)
+			if err == nil {
+				setDomainSet(s)
+			}
+			return err
+		}, false})
+	}
+	if src := cfg.GeoIPDB; src != "" {
+		lists = append(lists, remoteList{"geoip", src, cfg.GeoIPDBSource.Refresh, cfg.GeoIPDBSource.FetchConfig, geoIPValidator(), func() error {
+			InitGeoIPDB()
+			return nil
+		}, false})
+	}
+
+	remote := lists[:0]
+	for _, l := range lists {
+		if isRemoteSource(l.source) {
+			remote = append(remote, l)
+		}
+	}
+	return remote
+}
+
+// listRefreshFailures 记录每个数据源最近一次下载失败的时间，只在刷新协程中访问
+var listRefreshFailures = make(map[string]time.Time)
+
+// refreshRemoteListsPeriodically 定期检查远程数据源，缓存过期时重新下载
+func refreshRemoteListsPeriodically() {
+	for range time.Tick(listRefreshCheckInterval) {
+		refreshRemoteLists()
+	}
+}
+
+// refreshRemoteLists 刷新缓存已过期的远程数据源。多个集合可能共用一个地址（和缓存文件），
+// 按地址分组，每个地址只下载一次，有变化时重新加载组内所有集合。内容没有变化（304）时不重新加载；
+// 有变化时构建新的集合再原子替换，正在进行的匹配继续使用旧集合。IP 集合在本轮所有下载完成后只重建一次
+func refreshRemoteLists() {
+	var sources []string
+	groups := make(map[string][]remoteList)
+	for _, l := range remoteLists() {
+		if _, ok := groups[l.source]; !ok {
+			sources = append(sources, l.source)
+		}
+		groups[l.source] = append(groups[l.source], l)
+	}
+
+	rebuildIPSets := false
+	for _, source := range sources {
+		group := groups[source]
+		// 组内 refresh 不同时按最短的有效期检查
+		var maxAge time.Duration
+		for _, l := range group {
+			if d, err := parseCacheMaxAge(l.refresh); err == nil && (maxAge == 0 || d < maxAge) {
+				maxAge = d
+			}
+		}
+		if maxAge == 0 {
+			continue
+		}
+		if info, err := os.Stat(cachePath(source)); err == nil && time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if t, ok := listRefreshFailures[source]; ok && time.Since(t) < listRefreshRetryDelay {
+			continue
+		}
+
+		// 缓存是共用的，下载方式和校验用组内第一个集合的配置
+		changed, err := fetchRemote(source, group[0].fetch, group[0].validate)
+		if err != nil {
+			log.Printf("⚠ Failed to refresh %s: %v", group[0].name, err)
+			listRefreshFailures[source] = time.Now()
+			continue
+		}
+		delete(listRefreshFailures, source)
+		if !changed {
+			continue
+		}
+		for _, l := range group {
+			if l.reload != nil {
+				if err := l.reload(); err != nil {
+					log.Printf("❌ Failed to reload %s: %v", l.name, err)
+					continue
+				}
+			}
+			rebuildIPSets = rebuildIPSets || l.rebuildIPSets
+			log.Printf("🔄 Refreshed %s from %s", l.name, source)
+		}
+	}
+	if rebuildIPSets {
+		InitIPSets()
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// standInListServer 是一个支持 ETag 的列表服务器，body 可以在测试中修改
+type standInListServer struct {
+	mu          sync.Mutex
+	body        string
+	etag        string
+	conditional atomic.Int32 // 带 If-None-Match 的请求数
+	url         string
+}
+
+func startStandInListServer(t *testing.T, body, etag string) *standInListServer {
+	s := &standInListServer{body: body, etag: etag}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			s.conditional.Add(1)
+			if inm == s.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("ETag", s.etag)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(srv.Close)
+	s.url = srv.URL
+	return s
+}
+
+func (s *standInListServer) set(body, etag string) {
+	s.mu.Lock()
+	s.body, s.etag = body, etag
+	s.mu.Unlock()
+}
+
+// expireCache 把缓存文件的修改时间调到很久以前
+func expireCache(t *testing.T, file string) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchRemoteConditional(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "1.0.0.0/8\n", `"v1"`)
+
+	if changed, err := fetchRemote(srv.url, FetchConfig{}, newSourceValidator(VerifyConfig{}, countIPSetEntries)); err != nil || !changed {
+		t.Fatalf("first fetch: changed=%v err=%v", changed, err)
+	}
+	expireCache(t, cachePath(srv.url))
+	if changed, err := fetchRemote(srv.url, FetchConfig{}, newSourceValidator(VerifyConfig{}, countIPSetEntries)); err != nil || changed {
+		t.Fatalf("unchanged fetch: changed=%v err=%v", changed, err)
+	}
+	if srv.conditional.Load() != 1 {
+		t.Fatalf("conditional requests = %d, want 1", srv.conditional.Load())
+	}
+	if info, _ := os.Stat(cachePath(srv.url)); time.Since(info.ModTime()) > time.Minute {
+		t.Error("304 did not refresh the cache file time")
+	}
+}
+
+func TestFetchRemoteSizeLimit(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "1.0.0.0/8\n", `"v1"`)
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+	if _, err := fetchRemote(srv.url, FetchConfig{}, validate); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := remoteListSizeLimit
+	remoteListSizeLimit = 64
+	defer func() { remoteListSizeLimit = saved }()
+	srv.set(strings.Repeat("2.0.0.0/8\n", 10), `"v2"`)
+	expireCache(t, cachePath(srv.url))
+	if _, err := fetchRemote(srv.url, FetchConfig{}, validate); err == nil {
+		t.Fatal("oversized list accepted")
+	}
+	if data, _ := os.ReadFile(cachePath(srv.url)); string(data) != "1.0.0.0/8\n" {
+		t.Fatalf("cache overwritten with %q", data)
+	}
+}
+
+func TestRefreshRemoteListsSwapsIPSet(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "203.0.113.0/24\n", `"v1"`)
+	useTestIPSets(t, []IPSetConfig{{Name: "blocklist", Source: srv.url, Refresh: "1h"}})
+	old := getIPSet("blocklist")
+	if old == nil || !old.contains(net.ParseIP("203.0.113.1")) {
+		t.Fatal("initial load failed")
+	}
+
+	// 缓存未过期时不发请求
+	srv.set("198.51.100.0/24\n", `"v2"`)
+	refreshRemoteLists()
+	if getIPSet("blocklist") != old || srv.conditional.Load() != 0 {
+		t.Fatal("refreshed before the cache expired")
+	}
+
+	// 刷新期间并发读取，不能出现数据竞争
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			ipSetContains("blocklist", net.ParseIP("198.51.100.1"))
+		}
+	}()
+	expireCache(t, cachePath(srv.url))
+	refreshRemoteLists()
+	<-done
+
+	updated := getIPSet("blocklist")
+	if !updated.contains(net.ParseIP("198.51.100.1")) || updated.contains(net.ParseIP("203.0.113.1")) {
+		t.Fatal("IP set not replaced with the new list")
+	}
+	if !old.contains(net.ParseIP("203.0.113.1")) {
+		t.Fatal("old IP set was modified in place")
+	}
+
+	// 304 时不重新加载
+	expireCache(t, cachePath(srv.url))
+	refreshRemoteLists()
+	if getIPSet("blocklist") != updated {
+		t.Fatal("IP set reloaded although the remote list was not modified")
+	}
+}
+
+func TestRefreshRemoteListsDuringConfigUpdate(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "203.0.113.0/24\n", `"v1"`)
+	sets := []IPSetConfig{{Name: "blocklist", Source: srv.url, Refresh: "1h"}}
+	useTestIPSets(t, sets)
+
+	// 模拟 /api/config 在刷新的同时替换配置并重建集合
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			configMutex.Lock()
+			config.IPSets = append([]IPSetConfig(nil), sets...)
+			configMutex.Unlock()
+			InitIPSets()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		expireCache(t, cachePath(srv.url))
+		refreshRemoteLists()
+	}
+	<-done
+
+	if !ipSetContains("blocklist", net.ParseIP("203.0.113.1")) {
+		t.Fatal("IP set lost after concurrent rebuilds")
+	}
+}
+
+func TestInitIPSetsDownloadsWithoutLock(t *testing.T) {
+	useTestCacheDir(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("203.0.113.0/24\n"))
+	}))
+	defer srv.Close()
+	useTestIPSets(t, nil)
+
+	configMutex.Lock()
+	config.IPSets = []IPSetConfig{{Name: "slow", Source: srv.URL}}
+	configMutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		InitIPSets()
+	}()
+
+	// 下载还没完成时，单个集合的替换不会被阻塞
+	time.Sleep(50 * time.Millisecond)
+	swapped := make(chan struct{})
+	go func() {
+		setIPSet(&ipSet{name: "other"})
+		close(swapped)
+	}()
+	var blocked bool
+	select {
+	case <-swapped:
+	case <-time.After(time.Second):
+		blocked = true
+	}
+	close(release)
+	<-done
+	if blocked {
+		t.Fatal("setIPSet blocked while InitIPSets was downloading")
+	}
+	if !ipSetContains("slow", net.ParseIP("203.0.113.1")) {
+		t.Fatal("slow IP set not loaded")
+	}
+}
+
+func TestRefreshRemoteListsRebuildsIPSetsOnce(t *testing.T) {
+	useTestCacheDir(t)
+	a := startStandInListServer(t, "203.0.113.0/24\n", `"a1"`)
+	b := startStandInListServer(t, "198.51.100.0/24\n", `"b1"`)
+	useTestIPSets(t, []IPSetConfig{
+		{Name: "a", Source: a.url, Refresh: "1h"},
+		{Name: "b", Source: b.url, Refresh: "1h"},
+	})
+
+	a.set("192.0.2.0/24\n", `"a2"`)
+	b.set("100.64.0.0/10\n", `"b2"`)
+	expireCache(t, cachePath(a.url))
+	expireCache(t, cachePath(b.url))
+	ipSetsMutex.Lock()
+	before := ipSetsGen
+	ipSetsMutex.Unlock()
+	refreshRemoteLists()
+	ipSetsMutex.Lock()
+	rebuilds := ipSetsGen - before
+	ipSetsMutex.Unlock()
+
+	if rebuilds != 1 {
+		t.Errorf("IP sets rebuilt %d times in one refresh, want 1", rebuilds)
+	}
+	if !ipSetContains("a", net.ParseIP("192.0.2.1")) || !ipSetContains("b", net.ParseIP("100.64.0.1")) {
+		t.Error("IP sets not updated")
+	}
+}
+
+func TestRefreshRemoteListsReloadsSharedSource(t *testing.T) {
+	useTestCacheDir(t)
+	srv := startStandInListServer(t, "a.example\nb.example\n", `"v1"`)
+	config.DomainSets = []DomainSetConfig{
+		{Name: "first", Source: srv.url, Refresh: "1h"},
+		{Name: "second", Source: srv.url, Refresh: "1h"},
+	}
+	InitDomainSets()
+	defer func() {
+		config.DomainSets = nil
+		InitDomainSets()
+	}()
+	if !domainSetMatch("second", "a.example") {
+		t.Fatal("initial load failed")
+	}
+
+	// 两个集合共用一个地址，更新后都要重新加载
+	srv.set("c.example\n", `"v2"`)
+	expireCache(t, cachePath(srv.url))
+	refreshRemoteLists()
+	for _, name := range []string{"first", "second"} {
+		if !domainSetMatch(name, "c.example") || domainSetMatch(name, "a.example") {
+			t.Errorf("domain set %s not reloaded from the shared source", name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 路由动作，除此之外动作也可以是 proxies 中某个远端代理的名称
+const (
+	ActionDirect = "DIRECT"
+	ActionProxy  = "PROXY"
+	ActionReject = "REJECT"
+)
+
+// Rule 是一条编译后的路由规则，配置格式为 "TYPE,PAYLOAD,ACTION[,no-resolve]"，
+// MATCH 规则没有 PAYLOAD，写作 "MATCH,ACTION"
+type Rule struct {
+	Type      string
+	Payload   string
+	Action    string
+	NoResolve bool
+
+	ipnet     *net.IPNet
+	portStart int
+	portEnd   int
+}
+
+var (
+	routingRules []Rule
+	rulesMutex   sync.RWMutex
+)
+
+// InitRules 编译配置中的全局规则列表
+func InitRules() {
+	rules := compileRules(config.Rules)
+
+	rulesMutex.Lock()
+	routingRules = rules
+	rulesMutex.Unlock()
+	log.Printf("✔ Loaded %d routing rules", len(rules))
+}
+
+// compileRules 编译一组规则，无效的规则会被跳过
+func compileRules(lines []string) []Rule {
+	rules := make([]Rule, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			log.Printf("Skipping invalid rule %q: %v", line, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func parseRule(line string) (Rule, error) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	rule := Rule{Type: strings.ToUpper(parts[0])}
+	if rule.Type == "MATCH" {
+		if len(parts) != 2 {
+			return rule, fmt.Errorf("MATCH expects exactly one action")
+		}
+		rule.Action = parts[1]
+		return rule, checkRuleAction(&rule)
+	}
+
+	if len(parts) < 3 || len(parts) > 4 {
+		return rule, fmt.Errorf("expected TYPE,PAYLOAD,ACTION")
+	}
+	rule.Payload = parts[1]
+	rule.Action = parts[2]
+	if len(parts) == 4 {
+		if !strings.EqualFold(parts[3], "no-resolve") {
+			return rule, fmt.Errorf("unknown rule option %q", parts[3])
+		}
+		rule.NoResolve = true
+	}
+	if err := checkRuleAction(&rule); err != nil {
+		return rule, err
+	}
+
+	switch rule.Type {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		rule.Payload = strings.ToLower(strings.TrimSuffix(rule.Payload, "."))
+	case "IP-CIDR", "IP-CIDR6":
+		_, ipnet, err := net.ParseCIDR(rule.Payload)
+		if err != nil {
+			return rule, err
+		}
+		rule.Type = "IP-CIDR"
+		rule.ipnet = ipnet
+	case "GEOIP":
+		// 国家代码查询 geoip_db；CN 在没有 MMDB 或查不到时使用 china_ips
+		rule.Payload = strings.ToUpper(rule.Payload)
+		if len(rule.Payload) != 2 {
+			return rule, fmt.Errorf("GEOIP expects a two-letter country code")
+		}
+	case "DOMAIN-SET":
+		if !isDomainSetName(rule.Payload) {
+			return rule, fmt.Errorf("unknown domain set %s", rule.Payload)
+		}
+	case "IP-SET":
+		if !isIPSetName(rule.Payload) {
+			return rule, fmt.Errorf("unknown IP set %s", rule.Payload)
+		}
+	case "PORT", "DST-PORT":
+		start, end, err := parsePortRange(rule.Payload)
+		if err != nil {
+			return rule, err
+		}
+		rule.Type = "PORT"
+		rule.portStart, rule.portEnd = start, end
+	default:
+		return rule, fmt.Errorf("unknown rule type %s", rule.Type)
+	}
+	return rule, nil
+}
+
+// checkRuleAction 规范化内置动作的大小写，其余动作必须是已配置的远端代理名称
+func checkRuleAction(rule *Rule) error {
+	switch action := strings.ToUpper(rule.Action); action {
+	case ActionDirect, ActionProxy, ActionReject:
+		rule.Action = action
+		return nil
+	}
+	if isUpstreamName(rule.Action) {
+		return nil
+	}
+	return fmt.Errorf("unknown action or proxy %s", rule.Action)
+}
+
+// parsePortRange 解析 "443" 或 "8000-9000"
+func parsePortRange(s string) (int, int, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	start, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	end := start
+	if found {
+		if end, err = strconv.Atoi(hi); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if start < 0 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return start, end, nil
+}
+
+// ruleTarget 保存一次匹配过程中的目标信息，域名只在遇到 IP 类规则时才解析一次
+type ruleTarget struct {
+	host     string
+	port     int
+	ips      []net.IP
+	resolved bool
+}
+
+func (t *ruleTarget) resolve() []net.IP {
+	if !t.resolved {
+		t.resolved = true
+		if ip := net.ParseIP(t.host); ip != nil {
+			t.ips = []net.IP{ip}
+		} else if !localResolveAllowed() {
+			// 不在本地解析，域名不会命中 IP 类规则
+		} else if ips, err := lookupIP(t.host); err == nil {
+			t.ips = ips
+		} else {
+			log.Printf("DNS lookup failed for %s: %v", t.host, err)
+		}
+	}
+	return t.ips
+}
+
+func (r *Rule) match(t *ruleTarget) bool {
+	switch r.Type {
+	case "MATCH":
+		return true
+	case "DOMAIN":
+		return t.host == r.Payload
+	case "DOMAIN-SUFFIX":
+		return t.host == r.Payload || strings.HasSuffix(t.host, "."+r.Payload)
+	case "DOMAIN-KEYWORD":
+		return strings.Contains(t.host, r.Payload)
+	case "DOMAIN-SET":
+		return net.ParseIP(t.host) == nil && domainSetMatch(r.Payload, t.host)
+	case "PORT":
+		return t.port >= r.portStart && t.port <= r.portEnd
+	case "IP-CIDR", "GEOIP", "IP-SET":
+		if r.NoResolve && net.ParseIP(t.host) == nil {
+			return false
+		}
+		for _, ip := range t.resolve() {
+			if r.Type == "IP-CIDR" && r.ipnet.Contains(ip) {
+				return true
+			}
+			if r.Type == "GEOIP" && geoIPMatch(ip, r.Payload) {
+				return true
+			}
+			if r.Type == "IP-SET" && ipSetContains(r.Payload, ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchRules 按顺序匹配全局规则，返回第一条命中规则的动作
+func matchRules(target string) (string, bool) {
+	rulesMutex.RLock()
+	rules := routingRules
+	rulesMutex.RUnlock()
+	return matchRuleList(rules, target)
+}
+
+// matchRuleList 按顺序匹配给定的规则列表
+func matchRuleList(rules []Rule, target string) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	port, _ := strconv.Atoi(portStr)
+	t := &ruleTarget{host: strings.ToLower(strings.TrimSuffix(host, ".")), port: port}
+
+	for i := range rules {
+		if rules[i].match(t) {
+			return rules[i].Action, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchRules(t *testing.T) {
+	config.Rules = []string{
+		"DOMAIN,exact.example.com,REJECT",
+		"DOMAIN-SUFFIX,google.com,PROXY",
+		"DOMAIN-KEYWORD,corp,DIRECT",
+		"IP-CIDR,203.0.113.0/24,DIRECT,no-resolve",
+		"PORT,25,REJECT",
+		"BOGUS,whatever,DIRECT",
+		"MATCH,PROXY",
+	}
+	InitRules()
+	defer func() {
+		config.Rules = nil
+		InitRules()
+	}()
+
+	cases := []struct {
+		target string
+		expect string
+	}{
+		{"exact.example.com:443", ActionReject},
+		{"www.google.com:443", ActionProxy},
+		{"google.com:80", ActionProxy},
+		{"notgoogle.com:80", ActionProxy}, // 落到 MATCH
+		{"git.corp.example:22", ActionDirect},
+		{"203.0.113.7:443", ActionDirect},
+		{"198.51.100.1:25", ActionReject},
+		{"198.51.100.1:443", ActionProxy},
+	}
+	for _, c := range cases {
+		action, ok := matchRules(c.target)
+		if !ok || action != c.expect {
+			t.Errorf("matchRules(%s) = %q, %v; want %q", c.target, action, ok, c.expect)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,SOMEWHERE",
+		"IP-CIDR,not-a-cidr,DIRECT",
+		"PORT,70000,DIRECT",
+		"MATCH",
+	} {
+		if _, err := parseRule(line); err == nil {
+			t.Errorf("parseRule(%q) should fail", line)
+		}
+	}
+}
+
+func TestRuleActionNamedProxy(t *testing.T) {
+	config.Proxies = []UpstreamConfig{
+		{Name: "office", Type: "socks5", Server: "127.0.0.1", Port: 1081},
+		{Name: "cloud", Type: "socks5", Server: "127.0.0.1", Port: 1082},
+		{Name: "broken", Type: "ftp", Server: "127.0.0.1", Port: 1083},
+	}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	rule, err := parseRule("DOMAIN-SUFFIX,corp.example,office")
+	if err != nil || rule.Action != "office" {
+		t.Fatalf("parseRule = %+v, %v; want action office", rule, err)
+	}
+	if _, err := parseRule("DOMAIN-SUFFIX,corp.example,nowhere"); err == nil {
+		t.Errorf("rule with unknown proxy should fail")
+	}
+	// 类型无效、被 InitUpstreams 跳过的代理不能作为动作
+	if _, err := parseRule("DOMAIN-SUFFIX,corp.example,broken"); err == nil {
+		t.Errorf("rule with a skipped proxy should fail")
+	}
+
+	for name, want := range map[string]bool{"": true, "PROXY": true, "cloud": true, "nowhere": false} {
+		if _, err := getUpstreamDialer(name); (err == nil) != want {
+			t.Errorf("getUpstreamDialer(%q) err = %v", name, err)
+		}
+	}
+	if defaultUpstream != "office" {
+		t.Errorf("default upstream = %s; want office", defaultUpstream)
+	}
+}
+
+func TestRoutingResolvesOnlyWhenNeeded(t *testing.T) {
+	s := startStandInDNS(t, map[string][]net.IP{"intranet.test": {net.ParseIP("10.1.2.3")}})
+	useTestResolver(t, s.addr)
+
+	rules := compileRules([]string{
+		"DOMAIN-SUFFIX,proxied.test,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"MATCH,PROXY",
+	})
+	queries := func() int32 { return s.udpHits.Load() + s.tcpHits.Load() }
+
+	// 域名规则在前，命中时不应产生任何查询
+	if action, _ := matchRuleList(rules, "www.proxied.test:443"); action != ActionProxy {
+		t.Fatalf("got %s, want PROXY", action)
+	}
+	if got := queries(); got != 0 {
+		t.Fatalf("domain rule match sent %d DNS queries, want 0", got)
+	}
+
+	// 遇到 IP 类规则时才解析
+	if action, _ := matchRuleList(rules, "intranet.test:80"); action != ActionDirect {
+		t.Fatalf("got %s, want DIRECT", action)
+	}
+	if queries() == 0 {
+		t.Fatal("IP-CIDR rule did not resolve the domain")
+	}
+
+	// never 模式下域名不在本地解析，IP 规则跳过，未命中规则时也不做中国 IP 判断
+	config.DNS.ResolveMode = resolveNever
+	InitResolver()
+	before := queries()
+	if action, _ := matchRuleList(rules, "intranet.test:80"); action != ActionProxy {
+		t.Fatalf("never mode: got %s, want PROXY", action)
+	}
+	if IsDirectTarget("intranet.test:80") {
+		t.Fatal("never mode: IsDirectTarget resolved a domain")
+	}
+	if got := queries(); got != before {
+		t.Fatalf("never mode sent %d DNS queries, want 0", got-before)
+	}
+	// IP 字面量仍按 IP 规则匹配
+	if action, _ := matchRuleList(rules, "10.9.9.9:80"); action != ActionDirect {
+		t.Fatalf("never mode: got %s for an IP literal, want DIRECT", action)
+	}
+}
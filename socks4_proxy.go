@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 应答码
+const (
+	socks4Granted        = 0x5A
+	socks4Rejected       = 0x5B
+	socks4UserIDMismatch = 0x5D
+)
+
+var errSocks4FieldTooLong = errors.New("SOCKS4 field too long")
+
+// handleSocks4Connection 处理 SOCKS4/4a 的 CONNECT 请求，版本字节尚未被读取。
+// SOCKS4 只有 USERID 没有密码，配置了 users 时直接拒绝
+func handleSocks4Connection(conn net.Conn, buf *bufio.Reader, in *inbound) {
+	// VN CD DSTPORT(2) DSTIP(4)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		log.Println("Failed to read SOCKS4 request:", err)
+		return
+	}
+	cmd := header[1]
+	port := int(binary.BigEndian.Uint16(header[2:4]))
+	ip := net.IP(header[4:8])
+
+	userID, err := readNullTerminated(buf)
+	if err != nil {
+		log.Println("Failed to read SOCKS4 USERID:", err)
+		return
+	}
+	host := ip.String()
+	// SOCKS4a：DSTIP 为 0.0.0.x（x 非 0）时，USERID 之后跟着目标域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNullTerminated(buf); err != nil {
+			log.Println("Failed to read SOCKS4a domain:", err)
+			return
+		}
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if in.authRequired() {
+		log.Printf("SOCKS4 request for %s from %s rejected: authentication required", target, conn.RemoteAddr())
+		conn.Write(socks4Reply(socks4UserIDMismatch, nil))
+		return
+	}
+	if cmd != socks5CmdConnect {
+		log.Println("Unsupported SOCKS4 command:", cmd)
+		conn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+
+	if userID != "" {
+		log.Printf("SOCKS4 connect target: %s (userid: %s)", target, userID)
+	} else {
+		log.Printf("SOCKS4 connect target: %s", target)
+	}
+	remoteConn, err := in.dial(target)
+	if err != nil {
+		log.Printf("SOCKS4 connect %s failed: %v", target, err)
+		conn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+	if _, err := conn.Write(socks4Reply(socks4Granted, remoteConn.LocalAddr())); err != nil {
+		log.Println("Failed to write SOCKS4 reply:", err)
+		remoteConn.Close()
+		return
+	}
+	relayConns(&bufferedConn{Conn: conn, r: buf}, remoteConn)
+}
+
+// socks4Reply 构造应答：VN(0) CD DSTPORT DSTIP，只能携带 IPv4 地址
+func socks4Reply(code byte, addr net.Addr) []byte {
+	reply := []byte{0x00, code, 0, 0, 0, 0, 0, 0}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(a.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	return reply
+}
+
+// readNullTerminated 读取以 0 结尾的字符串，长度上限 255
+func readNullTerminated(buf *bufio.Reader) (string, error) {
+	var b []byte
+	for len(b) <= 255 {
+		c, err := buf.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+	return "", errSocks4FieldTooLong
+}
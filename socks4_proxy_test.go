@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocks4Connect(t *testing.T) {
+	origin := newOriginServer(t)
+	originHost, originPort, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+	port, _ := strconv.Atoi(originPort)
+	addr := startTestSocks5(t)
+
+	requests := map[string][]byte{
+		// SOCKS4：直接携带 IPv4
+		"socks4": append([]byte{0x04, 0x01, byte(port >> 8), byte(port)}, append(net.ParseIP(originHost).To4(), "bob\x00"...)...),
+		// SOCKS4a：DSTIP 为 0.0.0.1，域名跟在 USERID 后面
+		"socks4a": append([]byte{0x04, 0x01, byte(port >> 8), byte(port), 0, 0, 0, 1}, "bob\x00localhost\x00"...),
+	}
+	for name, req := range requests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(req)
+		br := bufio.NewReader(conn)
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(br, reply); err != nil {
+			t.Fatalf("%s: read reply: %v", name, err)
+		}
+		if reply[1] != socks4Granted {
+			t.Errorf("%s: reply code = %#x", name, reply[1])
+			conn.Close()
+			continue
+		}
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: read response: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != "hello from origin" {
+			t.Errorf("%s: body = %q", name, body)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// socks5ClientHandshake 连接远端 SOCKS5 并完成方法协商和认证，
+// 用于 x/net/proxy 不支持的 BIND 和 UDP ASSOCIATE 命令
+func socks5ClientHandshake(u *upstream) (net.Conn, *bufio.Reader, error) {
+	ctrl, err := outboundDialer(upstreamHandshakeTimeout).Dial("tcp", u.cfg.addr())
+	if err != nil {
+		return nil, nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	defer ctrl.SetDeadline(time.Time{})
+	br := bufio.NewReader(ctrl)
+
+	fail := func(err error) (net.Conn, *bufio.Reader, error) {
+		ctrl.Close()
+		return nil, nil, fmt.Errorf("upstream %s handshake: %w", u.cfg.Name, err)
+	}
+
+	greeting := []byte{0x05, 0x01, socks5MethodNoAuth}
+	if u.cfg.Username != "" {
+		greeting = []byte{0x05, 0x02, socks5MethodNoAuth, socks5MethodUserPass}
+	}
+	if _, err := ctrl.Write(greeting); err != nil {
+		return fail(err)
+	}
+	selected := make([]byte, 2)
+	if _, err := io.ReadFull(br, selected); err != nil {
+		return fail(err)
+	}
+	switch selected[1] {
+	case socks5MethodNoAuth:
+	case socks5MethodUserPass:
+		req := []byte{0x01, byte(len(u.cfg.Username))}
+		req = append(req, u.cfg.Username...)
+		req = append(req, byte(len(u.cfg.Password)))
+		req = append(req, u.cfg.Password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return fail(err)
+		}
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(br, status); err != nil {
+			return fail(err)
+		}
+		if status[1] != 0x00 {
+			return fail(fmt.Errorf("authentication failed"))
+		}
+	default:
+		return fail(fmt.Errorf("no acceptable auth method"))
+	}
+	return ctrl, br, nil
+}
+
+// socks5ClientRequest 发送一个命令请求
+func socks5ClientRequest(ctrl net.Conn, cmd byte, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	_, err = ctrl.Write(appendSocks5Addr([]byte{0x05, cmd, 0x00}, host, port))
+	return err
+}
+
+// readSocks5Reply 读取一个命令应答，返回 REP 和 BND 地址；
+// 远端返回 0.0.0.0 时用控制连接的对端 IP 代替
+func readSocks5Reply(br *bufio.Reader, ctrl net.Conn) (byte, net.Addr, error) {
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(br, reply); err != nil {
+		return 0, nil, err
+	}
+	host, err := readSocks5Addr(br, reply[3])
+	if err != nil {
+		return 0, nil, err
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(br, portBytes); err != nil {
+		return 0, nil, err
+	}
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return reply[1], &socks5DomainAddr{host: host, port: port}, nil
+	}
+	if ip.IsUnspecified() {
+		ip = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return reply[1], &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// socks5DomainAddr 是以域名表示的 BND 地址
+type socks5DomainAddr struct {
+	host string
+	port int
+}
+
+func (a *socks5DomainAddr) Network() string { return "tcp" }
+func (a *socks5DomainAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(a.port)) }
@@ -2,35 +2,59 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// handleSocks5Connection 实现一个最简版 SOCKS5 代理，仅支持 CONNECT 命令和无认证模式
-func handleSocks5Connection(conn net.Conn) {
+// SOCKS5 命令
+const (
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+)
+
+// SOCKS5 应答码（RFC 1928 第 6 节）
+const (
+	socks5RepSucceeded          = 0x00
+	socks5RepGeneralFailure     = 0x01
+	socks5RepNotAllowed         = 0x02
+	socks5RepNetworkUnreachable = 0x03
+	socks5RepHostUnreachable    = 0x04
+	socks5RepConnectionRefused  = 0x05
+	socks5RepTTLExpired         = 0x06
+	socks5RepCmdNotSupported    = 0x07
+	socks5RepAddrNotSupported   = 0x08
+)
+
+// socks5BindTimeout 是 BIND 等待对端连入的最长时间
+const socks5BindTimeout = 2 * time.Minute
+
+// SOCKS5 认证方法
+const (
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+)
+
+// handleSocks5Connection 实现一个 SOCKS5 代理，支持 CONNECT、BIND 和 UDP ASSOCIATE 命令，
+// 配置了 users 时要求用户名/密码认证（RFC 1929），否则使用无认证模式。
+// 版本号为 0x04 的连接交给 SOCKS4/4a 处理
+func handleSocks5Connection(conn net.Conn, in *inbound) {
 	defer conn.Close()
 	buf := bufio.NewReader(conn)
-	// 读取握手：版本和方法数量
-	header := make([]byte, 2)
-	if _, err := io.ReadFull(buf, header); err != nil {
-		log.Println("Failed to read SOCKS5 handshake:", err)
-		return
-	}
-	if header[0] != 0x05 {
-		log.Println("Unsupported SOCKS version:", header[0])
+	if version, err := buf.Peek(1); err == nil && version[0] == 0x04 {
+		handleSocks4Connection(conn, buf, in)
 		return
 	}
-	nmethods := int(header[1])
-	methods := make([]byte, nmethods)
-	if _, err := io.ReadFull(buf, methods); err != nil {
-		log.Println("Failed to read SOCKS5 methods:", err)
-		return
-	}
-	// 回复：选择无认证方式（0x00）
-	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
-		log.Println("Failed to write SOCKS5 method selection:", err)
+	user, ok := socks5Handshake(conn, buf, in)
+	if !ok {
 		return
 	}
 	// 读取请求头（前4字节）
@@ -43,41 +67,14 @@ func handleSocks5Connection(conn net.Conn) {
 		log.Println("Invalid SOCKS version in request:", reqHeader[0])
 		return
 	}
-	if reqHeader[1] != 0x01 { // 只支持 CONNECT 命令
-		log.Println("Unsupported SOCKS5 command:", reqHeader[1])
-		return
-	}
+	cmd := reqHeader[1]
 	addrType := reqHeader[3]
-	var destAddr string
-	switch addrType {
-	case 0x01: // IPv4
-		addrBytes := make([]byte, 4)
-		if _, err := io.ReadFull(buf, addrBytes); err != nil {
-			log.Println("Failed to read IPv4 address:", err)
-			return
-		}
-		destAddr = net.IP(addrBytes).String()
-	case 0x03: // 域名
-		domainLen, err := buf.ReadByte()
-		if err != nil {
-			log.Println("Failed to read domain length:", err)
-			return
-		}
-		domainBytes := make([]byte, domainLen)
-		if _, err := io.ReadFull(buf, domainBytes); err != nil {
-			log.Println("Failed to read domain:", err)
-			return
-		}
-		destAddr = string(domainBytes)
-	case 0x04: // IPv6
-		addrBytes := make([]byte, 16)
-		if _, err := io.ReadFull(buf, addrBytes); err != nil {
-			log.Println("Failed to read IPv6 address:", err)
-			return
+	destAddr, err := readSocks5Addr(buf, addrType)
+	if err != nil {
+		log.Println("Failed to read SOCKS5 address:", err)
+		if errors.Is(err, errSocks5AddrType) {
+			conn.Write(socks5Reply(socks5RepAddrNotSupported, nil))
 		}
-		destAddr = net.IP(addrBytes).String()
-	default:
-		log.Println("Unsupported address type:", addrType)
 		return
 	}
 	// 读取目标端口（2字节）
@@ -88,24 +85,322 @@ func handleSocks5Connection(conn net.Conn) {
 	}
 	port := int(portBytes[0])<<8 | int(portBytes[1])
 	target := fmt.Sprintf("%s:%d", destAddr, port)
-	log.Printf("SOCKS5 connect target: %s", target)
-	remoteConn, err := dialTarget(target)
+
+	switch cmd {
+	case socks5CmdConnect:
+		handleSocks5Connect(conn, buf, target, user, in)
+	case socks5CmdBind:
+		handleSocks5Bind(conn, buf, target, user, in)
+	case socks5CmdUDPAssociate:
+		handleSocks5UDPAssociate(conn, buf, user, in)
+	default:
+		log.Println("Unsupported SOCKS5 command:", cmd)
+		conn.Write(socks5Reply(socks5RepCmdNotSupported, nil))
+	}
+}
+
+// handleSocks5Connect 处理 CONNECT 命令，建立到目标的 TCP 连接并双向转发
+func handleSocks5Connect(conn net.Conn, buf *bufio.Reader, target, user string, in *inbound) {
+	if user != "" {
+		log.Printf("SOCKS5 connect target: %s (user: %s)", target, user)
+	} else {
+		log.Printf("SOCKS5 connect target: %s", target)
+	}
+	remoteConn, err := in.dial(target)
 	if err != nil {
-		// 回复失败：一般返回 0x01 表示通用错误
-		reply := []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-		conn.Write(reply)
+		log.Printf("SOCKS5 connect %s failed: %v", target, err)
+		conn.Write(socks5Reply(socks5ReplyCode(err), nil))
 		return
 	}
-	// 回复成功（此处绑定地址和端口置0）
-	reply := []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-	if _, err := conn.Write(reply); err != nil {
+	// 回复成功，BND.ADDR 为出站连接的本地地址
+	if _, err := conn.Write(socks5Reply(socks5RepSucceeded, remoteConn.LocalAddr())); err != nil {
 		log.Println("Failed to write SOCKS5 reply:", err)
+		remoteConn.Close()
 		return
 	}
-	// 开始双向转发数据
-	done := make(chan struct{})
-	go transferData(remoteConn, conn, done) // 客户端 → 远程
-	go transferData(conn, remoteConn, done) // 远程 → 客户端
-	// 等其中一个方向断开，就结束
+	// 客户端可能没等回复就发送了数据，这部分已经读进 buf
+	relayConns(&bufferedConn{Conn: conn, r: buf}, remoteConn)
+}
+
+// relayConns 在两个连接之间双向转发数据，任一方向断开即结束
+func relayConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go transferData(b, a, done) // 客户端 → 远程
+	go transferData(a, b, done) // 远程 → 客户端
 	<-done
 }
+
+// handleSocks5Bind 处理 BIND 命令。直连目标在本机监听等待对端连入，
+// 走代理的目标转交给远端 SOCKS5 执行 BIND
+func handleSocks5Bind(conn net.Conn, buf *bufio.Reader, target, user string, in *inbound) {
+	if user != "" {
+		log.Printf("SOCKS5 bind for %s (user: %s)", target, user)
+	} else {
+		log.Printf("SOCKS5 bind for %s", target)
+	}
+	switch action := in.route(target); action {
+	case ActionReject:
+		conn.Write(socks5Reply(socks5RepNotAllowed, nil))
+	case ActionDirect:
+		handleSocks5BindDirect(conn, buf, target)
+	default:
+		handleSocks5BindUpstream(conn, buf, action, target)
+	}
+}
+
+func handleSocks5BindDirect(conn net.Conn, buf *bufio.Reader, target string) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: conn.LocalAddr().(*net.TCPAddr).IP})
+	if err != nil {
+		log.Println("SOCKS5 bind listen failed:", err)
+		conn.Write(socks5Reply(socks5ReplyCode(err), nil))
+		return
+	}
+	defer ln.Close()
+	// 第一次应答：告诉客户端监听地址
+	if _, err := conn.Write(socks5Reply(socks5RepSucceeded, ln.Addr())); err != nil {
+		return
+	}
+
+	ln.SetDeadline(time.Now().Add(socks5BindTimeout))
+	peer, err := ln.AcceptTCP()
+	if err != nil {
+		log.Println("SOCKS5 bind accept failed:", err)
+		conn.Write(socks5Reply(socks5ReplyCode(err), nil))
+		return
+	}
+	// DST.ADDR 为 IP 时只接受来自该地址的连接
+	host, _, _ := net.SplitHostPort(target)
+	if expected := net.ParseIP(host); expected != nil && !expected.IsUnspecified() {
+		if !peer.RemoteAddr().(*net.TCPAddr).IP.Equal(expected) {
+			log.Printf("SOCKS5 bind: unexpected peer %s (want %s)", peer.RemoteAddr(), expected)
+			conn.Write(socks5Reply(socks5RepNotAllowed, nil))
+			peer.Close()
+			return
+		}
+	}
+	// 第二次应答：告诉客户端对端地址
+	if _, err := conn.Write(socks5Reply(socks5RepSucceeded, peer.RemoteAddr())); err != nil {
+		peer.Close()
+		return
+	}
+	// 和 CONNECT 一样，客户端提前发送的数据已经读进 buf
+	relayConns(&bufferedConn{Conn: conn, r: buf}, peer)
+}
+
+func handleSocks5BindUpstream(conn net.Conn, buf *bufio.Reader, action, target string) {
+	u, err := getUpstream(action)
+	if err != nil {
+		log.Println("SOCKS5 bind:", err)
+		conn.Write(socks5Reply(socks5RepGeneralFailure, nil))
+		return
+	}
+	if !u.isSOCKS5() {
+		log.Printf("SOCKS5 bind: upstream %s (%s) does not support BIND", u.cfg.Name, u.cfg.Type)
+		conn.Write(socks5Reply(socks5RepCmdNotSupported, nil))
+		return
+	}
+	ctrl, br, err := socks5ClientHandshake(u)
+	if err != nil {
+		log.Println("SOCKS5 bind:", err)
+		conn.Write(socks5Reply(socks5ReplyCode(err), nil))
+		return
+	}
+	defer ctrl.Close()
+	if err := socks5ClientRequest(ctrl, socks5CmdBind, target); err != nil {
+		conn.Write(socks5Reply(socks5ReplyCode(err), nil))
+		return
+	}
+	// 远端的两次应答原样转给客户端
+	for i := 0; i < 2; i++ {
+		ctrl.SetReadDeadline(time.Now().Add(socks5BindTimeout))
+		rep, bound, err := readSocks5Reply(br, ctrl)
+		if err != nil {
+			log.Println("SOCKS5 bind via upstream failed:", err)
+			conn.Write(socks5Reply(socks5RepGeneralFailure, nil))
+			return
+		}
+		if _, err := conn.Write(socks5Reply(rep, bound)); err != nil || rep != socks5RepSucceeded {
+			return
+		}
+	}
+	ctrl.SetReadDeadline(time.Time{})
+	relayConns(&bufferedConn{Conn: conn, r: buf}, &bufferedConn{Conn: ctrl, r: br})
+}
+
+// socks5ReplyCode 把拨号错误映射为 RFC 1928 应答码
+func socks5ReplyCode(err error) byte {
+	if errors.Is(err, errRejected) {
+		return socks5RepNotAllowed
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		// 同时识别 Unix 错误码和 Windows 的 WSA 错误码
+		switch errno {
+		case syscall.ENETUNREACH, 10051:
+			return socks5RepNetworkUnreachable
+		case syscall.EHOSTUNREACH, 10065:
+			return socks5RepHostUnreachable
+		case syscall.ECONNREFUSED, 10061:
+			return socks5RepConnectionRefused
+		case syscall.ETIMEDOUT, 10060:
+			return socks5RepTTLExpired
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5RepHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5RepTTLExpired
+	}
+
+	// 远端 SOCKS5 返回的错误只能通过错误文本识别
+	msg := err.Error()
+	for text, rep := range map[string]byte{
+		"not allowed by ruleset":     socks5RepNotAllowed,
+		"network unreachable":        socks5RepNetworkUnreachable,
+		"host unreachable":           socks5RepHostUnreachable,
+		"connection refused":         socks5RepConnectionRefused,
+		"TTL expired":                socks5RepTTLExpired,
+		"command not supported":      socks5RepCmdNotSupported,
+		"address type not supported": socks5RepAddrNotSupported,
+	} {
+		if strings.Contains(msg, text) {
+			return rep
+		}
+	}
+	return socks5RepGeneralFailure
+}
+
+// socks5Handshake 完成版本协商和认证，返回认证通过的用户名（无认证时为空）
+func socks5Handshake(conn net.Conn, buf *bufio.Reader, in *inbound) (string, bool) {
+	// 读取握手：版本和方法数量
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		log.Println("Failed to read SOCKS5 handshake:", err)
+		return "", false
+	}
+	if header[0] != 0x05 {
+		log.Println("Unsupported SOCKS version:", header[0])
+		return "", false
+	}
+	nmethods := int(header[1])
+	methods := make([]byte, nmethods)
+	if _, err := io.ReadFull(buf, methods); err != nil {
+		log.Println("Failed to read SOCKS5 methods:", err)
+		return "", false
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if in.authRequired() {
+		want = socks5MethodUserPass
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		log.Printf("SOCKS5 client %s offered no acceptable method %v", conn.RemoteAddr(), methods)
+		conn.Write([]byte{0x05, socks5MethodNoAcceptable})
+		return "", false
+	}
+	if _, err := conn.Write([]byte{0x05, want}); err != nil {
+		log.Println("Failed to write SOCKS5 method selection:", err)
+		return "", false
+	}
+	if want == socks5MethodNoAuth {
+		return "", true
+	}
+
+	// 用户名/密码子协商：VER ULEN UNAME PLEN PASSWD
+	ver, err := buf.ReadByte()
+	if err != nil || ver != 0x01 {
+		log.Println("Invalid SOCKS5 auth version:", ver, err)
+		return "", false
+	}
+	username, err := readSocks5String(buf)
+	if err != nil {
+		log.Println("Failed to read SOCKS5 username:", err)
+		return "", false
+	}
+	password, err := readSocks5String(buf)
+	if err != nil {
+		log.Println("Failed to read SOCKS5 password:", err)
+		return "", false
+	}
+	if !in.checkUser(username, password) {
+		log.Printf("SOCKS5 auth failed for user %q from %s", username, conn.RemoteAddr())
+		conn.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		log.Println("Failed to write SOCKS5 auth reply:", err)
+		return "", false
+	}
+	return username, true
+}
+
+// readSocks5String 读取一个长度前缀的字符串
+func readSocks5String(buf *bufio.Reader) (string, error) {
+	n, err := buf.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// errSocks5AddrType 表示不支持的地址类型
+var errSocks5AddrType = errors.New("unsupported address type")
+
+// readSocks5Addr 按地址类型读取 DST.ADDR，不含端口
+func readSocks5Addr(buf *bufio.Reader, addrType byte) (string, error) {
+	switch addrType {
+	case 0x01: // IPv4
+		addrBytes := make([]byte, 4)
+		if _, err := io.ReadFull(buf, addrBytes); err != nil {
+			return "", err
+		}
+		return net.IP(addrBytes).String(), nil
+	case 0x03: // 域名
+		return readSocks5String(buf)
+	case 0x04: // IPv6
+		addrBytes := make([]byte, 16)
+		if _, err := io.ReadFull(buf, addrBytes); err != nil {
+			return "", err
+		}
+		return net.IP(addrBytes).String(), nil
+	}
+	return "", fmt.Errorf("%w: %d", errSocks5AddrType, addrType)
+}
+
+// appendSocks5Addr 按 SOCKS5 格式编码 ATYP、ADDR 和 PORT
+func appendSocks5Addr(b []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, 0x01)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 0x04)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, 0x03, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// socks5Reply 构造命令应答，addr 为 BND.ADDR/BND.PORT，为 nil 时填 0.0.0.0:0
+func socks5Reply(rep byte, addr net.Addr) []byte {
+	host, port := "0.0.0.0", 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		host, port = a.IP.String(), a.Port
+	case *net.UDPAddr:
+		host, port = a.IP.String(), a.Port
+	case *socks5DomainAddr:
+		host, port = a.host, a.port
+	}
+	return appendSocks5Addr([]byte{0x05, rep, 0x00}, host, port)
+}
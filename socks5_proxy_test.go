@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startTestSocks5 在随机端口上启动 SOCKS5 监听，规则固定为直连
+func startTestSocks5(t *testing.T) string {
+	t.Helper()
+	config.Rules = []string{"MATCH,DIRECT"}
+	InitRules()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleSocks5Connection(conn, nil)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		config.Rules = nil
+		config.Users = nil
+		InitRules()
+	})
+	return ln.Addr().String()
+}
+
+func TestSocks5UserPassAuth(t *testing.T) {
+	origin := newOriginServer(t)
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+	config.Users = []UserConfig{{Username: "alice", Password: "secret"}}
+	addr := startTestSocks5(t)
+
+	good, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	client := &http.Client{Transport: &http.Transport{Dial: good.Dial}}
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatalf("GET through authenticated SOCKS5 failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from origin" {
+		t.Errorf("body = %q", body)
+	}
+
+	bad, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+	if conn, err := bad.Dial("tcp", originAddr); err == nil {
+		conn.Close()
+		t.Errorf("Dial with wrong password should fail")
+	}
+}
+
+func TestSocks5NoAcceptableMethod(t *testing.T) {
+	config.Users = []UserConfig{{Username: "alice", Password: "secret"}}
+	addr := startTestSocks5(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 只提供无认证方式
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0xFF {
+		t.Errorf("method selection = %x; want 05ff", reply)
+	}
+}
+
+// socks5Request 完成无认证握手并发送一个命令，返回第一个应答
+func socks5Request(t *testing.T, addr string, cmd byte, target string) (net.Conn, *bufio.Reader, byte, net.Addr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	br := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(br, method); err != nil {
+		t.Fatal(err)
+	}
+	if err := socks5ClientRequest(conn, cmd, target); err != nil {
+		t.Fatal(err)
+	}
+	rep, bound, err := readSocks5Reply(br, conn)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return conn, br, rep, bound
+}
+
+func TestSocks5ReplyCodes(t *testing.T) {
+	addr := startTestSocks5(t)
+
+	// 找一个没有监听的端口
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	conn, _, rep, _ := socks5Request(t, addr, socks5CmdConnect, closedAddr)
+	conn.Close()
+	if rep != socks5RepConnectionRefused {
+		t.Errorf("connect to closed port: rep = %d; want %d", rep, socks5RepConnectionRefused)
+	}
+
+	conn, _, rep, _ = socks5Request(t, addr, 0x09, closedAddr)
+	conn.Close()
+	if rep != socks5RepCmdNotSupported {
+		t.Errorf("unknown command: rep = %d; want %d", rep, socks5RepCmdNotSupported)
+	}
+
+	origin := newOriginServer(t)
+	conn, _, rep, bound := socks5Request(t, addr, socks5CmdConnect, strings.TrimPrefix(origin.URL, "http://"))
+	conn.Close()
+	if rep != socks5RepSucceeded || bound.(*net.TCPAddr).Port == 0 {
+		t.Errorf("connect: rep = %d, bound = %v; want success with real address", rep, bound)
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	addr := startTestSocks5(t)
+	conn, br, rep, bound := socks5Request(t, addr, socks5CmdBind, "127.0.0.1:0")
+	defer conn.Close()
+	if rep != socks5RepSucceeded {
+		t.Fatalf("bind: rep = %d", rep)
+	}
+
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatalf("dial bound address %s: %v", bound, err)
+	}
+	defer peer.Close()
+	rep, peerAddr, err := readSocks5Reply(br, conn)
+	if err != nil || rep != socks5RepSucceeded {
+		t.Fatalf("second bind reply: rep = %d, err = %v", rep, err)
+	}
+	if peerAddr.String() != peer.LocalAddr().String() {
+		t.Errorf("peer address = %s; want %s", peerAddr, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("relayed data = %q, %v", b, err)
+	}
+}
+
+func TestSocks5ConnectKeepsPipelinedData(t *testing.T) {
+	addr := startTestSocks5(t)
+	origin := newOriginServer(t)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 问候、CONNECT 请求和 HTTP 请求一次性发出，不等待任何回复
+	b := []byte{0x05, 0x01, socks5MethodNoAuth}
+	b = appendSocks5Addr(append(b, 0x05, socks5CmdConnect, 0x00), host, portNum)
+	b = append(b, "GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n"...)
+	conn.Write(b)
+
+	br := bufio.NewReader(conn)
+	if _, err := io.ReadFull(br, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if rep, _, err := readSocks5Reply(br, conn); err != nil || rep != socks5RepSucceeded {
+		t.Fatalf("connect reply = %d, %v", rep, err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("pipelined request lost: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from origin" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSocks5BindKeepsPipelinedData(t *testing.T) {
+	addr := startTestSocks5(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 问候、BIND 请求和要发给对端的数据一次性发出
+	b := []byte{0x05, 0x01, socks5MethodNoAuth}
+	b = appendSocks5Addr(append(b, 0x05, socks5CmdBind, 0x00), "127.0.0.1", 0)
+	conn.Write(append(b, "early"...))
+
+	br := bufio.NewReader(conn)
+	if _, err := io.ReadFull(br, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	rep, bound, err := readSocks5Reply(br, conn)
+	if err != nil || rep != socks5RepSucceeded {
+		t.Fatalf("bind reply = %d, %v", rep, err)
+	}
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "early" {
+		t.Errorf("peer received %q, %v; want the pipelined data", got, err)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpBufferSize 足够容纳一个最大的 UDP 包加上 SOCKS5 头
+const udpBufferSize = 65535 + 262
+
+// handleSocks5UDPAssociate 处理 UDP ASSOCIATE 命令：为每个关联打开一个中继 UDP 套接字，
+// 控制连接断开时关联结束
+func handleSocks5UDPAssociate(conn net.Conn, buf *bufio.Reader, user string, in *inbound) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Println("Failed to open UDP relay:", err)
+		conn.Write(socks5Reply(0x01, nil))
+		return
+	}
+	if _, err := conn.Write(socks5Reply(0x00, relay.LocalAddr())); err != nil {
+		log.Println("Failed to write SOCKS5 reply:", err)
+		relay.Close()
+		return
+	}
+	if user != "" {
+		log.Printf("SOCKS5 UDP associate %s -> %s (user: %s)", conn.RemoteAddr(), relay.LocalAddr(), user)
+	} else {
+		log.Printf("SOCKS5 UDP associate %s -> %s", conn.RemoteAddr(), relay.LocalAddr())
+	}
+
+	a := &udpAssociation{
+		in:         in,
+		relay:      relay,
+		clientIP:   conn.RemoteAddr().(*net.TCPAddr).IP,
+		routes:     make(map[string]string),
+		replyAddrs: make(map[string]string),
+		upstreams:  make(map[string]*upstreamUDP),
+	}
+	go a.serve()
+
+	// 控制连接上不会再有数据，读到 EOF 即表示客户端结束关联
+	io.Copy(io.Discard, buf)
+	a.close()
+}
+
+// udpAssociation 是一个 UDP ASSOCIATE 会话
+type udpAssociation struct {
+	in       *inbound
+	relay    *net.UDPConn
+	clientIP net.IP
+
+	mu        sync.Mutex
+	client    *net.UDPAddr
+	direct    *net.UDPConn
+	upstreams map[string]*upstreamUDP
+	routes    map[string]string
+	closed    bool
+
+	// replyAddrs 把直连目标的真实地址映射回客户端使用的假 IP 地址，
+	// 回包的来源必须是客户端发往的地址
+	replyAddrs map[string]string
+}
+
+// serve 读取客户端发往中继套接字的数据包，按路由转发
+func (a *udpAssociation) serve() {
+	b := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// 只接受发起关联的客户端的数据包
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		target, payload, err := parseSocks5UDPPacket(b[:n])
+		if err != nil {
+			log.Println("Dropping SOCKS5 UDP packet:", err)
+			continue
+		}
+		packet := b[:n]
+		dst := target
+		if restored := restoreFakeIP(target); restored != target {
+			// 假 IP 还原为域名，转发给远端中继的包头也要换成域名
+			host, port, _ := net.SplitHostPort(restored)
+			portNum, _ := strconv.Atoi(port)
+			target = restored
+			packet = append(appendSocks5Addr([]byte{0, 0, 0}, host, portNum), payload...)
+		}
+		if err := a.forward(target, dst, packet, payload); err != nil {
+			log.Printf("UDP %s: %v", target, err)
+		}
+	}
+}
+
+// forward 按路由把一个数据包发往目标，packet 为带 SOCKS5 头的原始包，dst 为客户端填写的目标
+// （可能是假 IP）。a.mu 只保护状态，路由、解析和远端握手都在锁外进行，不会阻塞回包
+func (a *udpAssociation) forward(target, dst string, packet, payload []byte) error {
+	a.mu.Lock()
+	action, ok := a.routes[target]
+	closed := a.closed
+	a.mu.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+	if !ok {
+		action = a.in.route(target)
+		a.mu.Lock()
+		a.routes[target] = action
+		a.mu.Unlock()
+		log.Printf("UDP %s -> %s", target, action)
+	}
+
+	switch action {
+	case ActionReject:
+		return nil
+	case ActionDirect:
+		direct, err := a.directConn()
+		if err != nil {
+			return err
+		}
+		addr, err := resolveUDPAddr(target)
+		if err != nil {
+			return err
+		}
+		if dst != target {
+			a.mu.Lock()
+			a.replyAddrs[addr.String()] = dst
+			a.mu.Unlock()
+		}
+		_, err = direct.WriteToUDP(payload, addr)
+		return err
+	}
+
+	up, err := a.upstreamConn(action)
+	if err != nil {
+		return err
+	}
+	// 远端 SOCKS5 使用同样的封装格式，原样转发即可
+	_, err = up.conn.Write(packet)
+	return err
+}
+
+// directConn 返回直连使用的 UDP 套接字，第一次使用时创建
+func (a *udpAssociation) directConn() (*net.UDPConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if a.direct == nil {
+		lc := net.ListenConfig{Control: routingMarkControl}
+		pc, err := lc.ListenPacket(context.Background(), "udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		direct := pc.(*net.UDPConn)
+		a.direct = direct
+		go a.readDirect(direct)
+	}
+	return a.direct, nil
+}
+
+// upstreamConn 返回到远端代理 action 的 UDP 关联，没有时在锁外握手建立
+func (a *udpAssociation) upstreamConn(action string) (*upstreamUDP, error) {
+	a.mu.Lock()
+	up, ok := a.upstreams[action]
+	a.mu.Unlock()
+	if ok {
+		return up, nil
+	}
+
+	u, err := getUpstream(action)
+	if err != nil {
+		return nil, err
+	}
+	if !u.isSOCKS5() {
+		return nil, fmt.Errorf("upstream %s (%s) does not support UDP", u.cfg.Name, u.cfg.Type)
+	}
+	up, err = dialUpstreamUDP(u)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		up.close()
+		return nil, net.ErrClosed
+	}
+	if existing, ok := a.upstreams[action]; ok {
+		up.close()
+		return existing, nil
+	}
+	a.upstreams[action] = up
+	go a.readUpstream(up)
+	return up, nil
+}
+
+// readDirect 把直连目标的响应封装后发回客户端
+func (a *udpAssociation) readDirect(direct *net.UDPConn) {
+	b := make([]byte, udpBufferSize)
+	for {
+		n, from, err := direct.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		host, port := from.IP.String(), from.Port
+		a.mu.Lock()
+		dst, ok := a.replyAddrs[from.String()]
+		a.mu.Unlock()
+		if ok {
+			h, p, _ := net.SplitHostPort(dst)
+			host = h
+			port, _ = strconv.Atoi(p)
+		}
+		packet := appendSocks5Addr([]byte{0, 0, 0}, host, port)
+		a.writeToClient(append(packet, b[:n]...))
+	}
+}
+
+// readUpstream 把远端中继的响应原样发回客户端，响应中已带有来源地址
+func (a *udpAssociation) readUpstream(up *upstreamUDP) {
+	b := make([]byte, udpBufferSize)
+	for {
+		n, err := up.conn.Read(b)
+		if err != nil {
+			return
+		}
+		a.writeToClient(b[:n])
+	}
+}
+
+func (a *udpAssociation) writeToClient(packet []byte) {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+	if client != nil {
+		a.relay.WriteToUDP(packet, client)
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.relay.Close()
+	if a.direct != nil {
+		a.direct.Close()
+	}
+	for _, up := range a.upstreams {
+		up.close()
+	}
+}
+
+// parseSocks5UDPPacket 解析 SOCKS5 UDP 请求头：RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+func parseSocks5UDPPacket(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("packet too short")
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("fragmented packets are not supported")
+	}
+	var host string
+	rest := b[4:]
+	switch b[3] {
+	case 0x01:
+		if len(rest) < 4 {
+			return "", nil, fmt.Errorf("packet too short")
+		}
+		host, rest = net.IP(rest[:4]).String(), rest[4:]
+	case 0x03:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", nil, fmt.Errorf("packet too short")
+		}
+		host, rest = string(rest[1:1+int(rest[0])]), rest[1+int(rest[0]):]
+	case 0x04:
+		if len(rest) < 16 {
+			return "", nil, fmt.Errorf("packet too short")
+		}
+		host, rest = net.IP(rest[:16]).String(), rest[16:]
+	default:
+		return "", nil, fmt.Errorf("unsupported address type: %d", b[3])
+	}
+	if len(rest) < 2 {
+		return "", nil, fmt.Errorf("packet too short")
+	}
+	port := int(rest[0])<<8 | int(rest[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), rest[2:], nil
+}
+
+// upstreamUDP 是与远端 SOCKS5 建立的 UDP 关联
+type upstreamUDP struct {
+	ctrl net.Conn
+	conn *net.UDPConn
+}
+
+// dialUpstreamUDP 在远端 SOCKS5 上发起 UDP ASSOCIATE，返回连到远端中继的 UDP 套接字
+func dialUpstreamUDP(u *upstream) (*upstreamUDP, error) {
+	ctrl, br, err := socks5ClientHandshake(u)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*upstreamUDP, error) {
+		ctrl.Close()
+		return nil, fmt.Errorf("upstream %s UDP associate: %v", u.cfg.Name, err)
+	}
+
+	ctrl.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err := socks5ClientRequest(ctrl, socks5CmdUDPAssociate, "0.0.0.0:0"); err != nil {
+		return fail(err)
+	}
+	rep, bound, err := readSocks5Reply(br, ctrl)
+	if err != nil {
+		return fail(err)
+	}
+	if rep != socks5RepSucceeded {
+		return fail(fmt.Errorf("reply code %d", rep))
+	}
+	relayAddr, err := upstreamRelayAddr(bound, ctrl)
+	if err != nil {
+		return fail(err)
+	}
+
+	conn, err := outboundDialer(0).Dial("udp", relayAddr.String())
+	if err != nil {
+		return fail(err)
+	}
+	ctrl.SetDeadline(time.Time{})
+	return &upstreamUDP{ctrl: ctrl, conn: conn.(*net.UDPConn)}, nil
+}
+
+// upstreamRelayAddr 返回远端中继的 UDP 地址。BND 为域名时先解析，解析失败则和
+// 0.0.0.0 一样使用控制连接的对端 IP
+func upstreamRelayAddr(bound net.Addr, ctrl net.Conn) (*net.UDPAddr, error) {
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}, nil
+	case *socks5DomainAddr:
+		if addr, err := resolveUDPAddr(a.String()); err == nil {
+			return addr, nil
+		}
+		return &net.UDPAddr{IP: ctrl.RemoteAddr().(*net.TCPAddr).IP, Port: a.port}, nil
+	}
+	return nil, fmt.Errorf("unsupported relay address %s", bound)
+}
+
+func (up *upstreamUDP) close() {
+	up.conn.Close()
+	up.ctrl.Close()
+}
+
+// resolveUDPAddr 通过带缓存的解析器解析 UDP 目标，优先使用 IPv4 地址
+func resolveUDPAddr(target string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSocks5UDPPacket(t *testing.T) {
+	packet := appendSocks5Addr([]byte{0, 0, 0}, "example.com", 53)
+	packet = append(packet, "payload"...)
+	target, payload, err := parseSocks5UDPPacket(packet)
+	if err != nil || target != "example.com:53" || string(payload) != "payload" {
+		t.Errorf("parse = %q, %q, %v", target, payload, err)
+	}
+
+	fragmented := append([]byte{0, 0, 1}, packet[3:]...)
+	if _, _, err := parseSocks5UDPPacket(fragmented); err == nil {
+		t.Errorf("fragmented packet should be rejected")
+	}
+	if _, _, err := parseSocks5UDPPacket(packet[:8]); err == nil {
+		t.Errorf("truncated packet should be rejected")
+	}
+}
+
+// startUDPEcho 启动一个 UDP 回显服务
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], from)
+		}
+	}()
+	return echo.LocalAddr().(*net.UDPAddr)
+}
+
+// socks5UDPAssociate 在 addr 上发起 UDP ASSOCIATE，返回连到中继地址的 UDP 套接字
+func socks5UDPAssociate(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	ctrl.Write([]byte{0x05, 0x01, 0x00})
+	ctrl.Write(appendSocks5Addr([]byte{0x05, socks5CmdUDPAssociate, 0x00}, "0.0.0.0", 0))
+
+	br := bufio.NewReader(ctrl)
+	reply := make([]byte, 2+4)
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0x00 {
+		t.Fatalf("UDP associate reply code = %d", reply[3])
+	}
+	host, err := readSocks5Addr(br, reply[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	portBytes := make([]byte, 2)
+	io.ReadFull(br, portBytes)
+	relay := &net.UDPAddr{IP: net.ParseIP(host), Port: int(portBytes[0])<<8 | int(portBytes[1])}
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// udpEchoRoundTrip 经 SOCKS5 中继向回显服务发送 ping，检查带来源地址头的回包
+func udpEchoRoundTrip(t *testing.T, client *net.UDPConn, echoAddr *net.UDPAddr) {
+	t.Helper()
+	header := appendSocks5Addr([]byte{0, 0, 0}, echoAddr.IP.String(), echoAddr.Port)
+	client.Write(append(header, "ping"...))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatalf("no UDP reply: %v", err)
+	}
+	if !bytes.Equal(b[:n], append(header, "ping"...)) {
+		t.Errorf("UDP reply = %x; want %x", b[:n], append(header, "ping"...))
+	}
+}
+
+func TestSocks5UDPAssociateDirect(t *testing.T) {
+	echoAddr := startUDPEcho(t)
+	client := socks5UDPAssociate(t, startTestSocks5(t))
+	udpEchoRoundTrip(t, client, echoAddr)
+}
+
+// startStandInUDPUpstream 启动一个只支持 UDP ASSOCIATE 的远端 SOCKS5 代理，中继把包直接发往目标，
+// conns 统计收到的控制连接
+func startStandInUDPUpstream(t *testing.T, conns *atomic.Int32) string {
+	t.Helper()
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := relay.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			target, payload, err := parseSocks5UDPPacket(b[:n])
+			if err != nil {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				continue
+			}
+			remote, err := net.DialUDP("udp", nil, addr)
+			if err != nil {
+				continue
+			}
+			remote.SetDeadline(time.Now().Add(time.Second))
+			remote.Write(payload)
+			r := make([]byte, 1500)
+			m, err := remote.Read(r)
+			remote.Close()
+			if err != nil {
+				continue
+			}
+			reply := appendSocks5Addr([]byte{0, 0, 0}, addr.IP.String(), addr.Port)
+			relay.WriteToUDP(append(reply, r[:m]...), from)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				buf := bufio.NewReader(conn)
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(buf, greeting); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(buf, make([]byte, greeting[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, 0x00})
+				head := make([]byte, 4)
+				if _, err := io.ReadFull(buf, head); err != nil || head[1] != socks5CmdUDPAssociate {
+					return
+				}
+				if _, err := readSocks5Addr(buf, head[3]); err != nil {
+					return
+				}
+				bound := relay.LocalAddr().(*net.UDPAddr)
+				conn.Write(appendSocks5Addr([]byte{0x05, 0x00, 0x00}, bound.IP.String(), bound.Port))
+				io.Copy(io.Discard, buf) // 控制连接关闭时关联结束
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSocks5UDPAssociateViaUpstream(t *testing.T) {
+	echoAddr := startUDPEcho(t)
+	var upstreamConns atomic.Int32
+	host, port, _ := net.SplitHostPort(startStandInUDPUpstream(t, &upstreamConns))
+	portNum, _ := strconv.Atoi(port)
+	config.Proxies = []UpstreamConfig{{Name: "up", Type: "socks5", Server: host, Port: portNum}}
+	InitUpstreams()
+	defer func() {
+		config.Proxies = nil
+		InitUpstreams()
+	}()
+
+	// 本地代理把所有 UDP 交给远端代理 up
+	addr := startTestSocks5(t)
+	config.Rules = []string{"MATCH,up"}
+	InitRules()
+
+	client := socks5UDPAssociate(t, addr)
+	udpEchoRoundTrip(t, client, echoAddr)
+	udpEchoRoundTrip(t, client, echoAddr)
+	if n := upstreamConns.Load(); n != 1 {
+		t.Errorf("upstream saw %d control connections, want the association reused", n)
+	}
+}
+
+// startStandInUDPRelayReply 启动一个只应答 UDP ASSOCIATE 的远端 SOCKS5，BND 为 bndHost:bndPort
+func startStandInUDPRelayReply(t *testing.T, listen, bndHost string, bndPort int) *upstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Skipf("listen on %s: %v", listen, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(br, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, socks5MethodNoAuth})
+				header := make([]byte, 4)
+				if _, err := io.ReadFull(br, header); err != nil {
+					return
+				}
+				readSocks5Addr(br, header[3])
+				io.ReadFull(br, make([]byte, 2))
+				conn.Write(appendSocks5Addr([]byte{0x05, socks5RepSucceeded, 0x00}, bndHost, bndPort))
+				io.Copy(io.Discard, br)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return &upstream{cfg: UpstreamConfig{Name: "relay", Type: "socks5", Server: host, Port: portNum}}
+}
+
+func TestDialUpstreamUDPDomainRelayAddress(t *testing.T) {
+	cases := []struct {
+		bnd  string
+		want string
+	}{
+		{"localhost", "127.0.0.1:4242"},     // 能解析的域名
+		{"relay.invalid", "127.0.0.2:4242"}, // 解析失败时使用控制连接的对端 IP
+	}
+	for _, c := range cases {
+		u := startStandInUDPRelayReply(t, "127.0.0.2:0", c.bnd, 4242)
+		up, err := dialUpstreamUDP(u)
+		if err != nil {
+			t.Errorf("BND %s: %v", c.bnd, err)
+			continue
+		}
+		if got := up.conn.RemoteAddr().String(); got != c.want {
+			t.Errorf("BND %s: relay = %s, want %s", c.bnd, got, c.want)
+		}
+		up.close()
+	}
+}
+
+func TestSocks5UDPDirectReplyFromFakeIP(t *testing.T) {
+	echoAddr := startUDPEcho(t)
+	s := startStandInDNS(t, map[string][]net.IP{"echo.test": {echoAddr.IP}})
+	// 不替换 timeNow，中继协程在测试结束后还可能查询缓存
+	config.DNS = DNSConfig{
+		Servers:     []string{s.addr},
+		FakeIPRange: "198.18.0.0/15",
+		FakeIPStore: filepath.Join(t.TempDir(), "fakeip.json"),
+	}
+	InitResolver()
+	t.Cleanup(func() {
+		config.DNS = DNSConfig{}
+		InitResolver()
+	})
+	fake := &net.UDPAddr{IP: currentFakeIPPool().lookup("echo.test"), Port: echoAddr.Port}
+
+	// 客户端发往假 IP，回包的来源也必须是假 IP，而不是真实地址
+	client := socks5UDPAssociate(t, startTestSocks5(t))
+	udpEchoRoundTrip(t, client, fake)
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func test_geoip() {
-	// 示例：远端加载 IP 网段文件，使用固定缓存文件名 "cache_ipranges.txt"
+	// 示例：远端加载 IP 网段文件，缓存在 ~/myproxy/cache 下按地址哈希命名的 <key>.data
 	remoteFilename := "https://example.com/ipranges.txt"
 	if err := loadIPRangesCached(remoteFilename); err != nil {
 		log.Fatalf("Failed to load IP ranges: %v", err)
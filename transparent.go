@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// tproxyUDPIdleTimeout 是透明 UDP 会话没有数据时的保留时间
+const tproxyUDPIdleTimeout = 60 * time.Second
+
+// errTransparentLoop 表示连接直接发往了透明入口本身，转发会形成回环
+var errTransparentLoop = errors.New("connection targets the transparent listener itself")
+
+// serveTransparent 接受被 iptables REDIRECT/TPROXY 转来的 TCP 连接，按原始目标地址路由
+func serveTransparent(ln net.Listener, in *inbound, originalDst func(net.Conn) (string, error)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Accept error:", err)
+			return
+		}
+		go handleTransparentConn(conn, in, originalDst)
+	}
+}
+
+func handleTransparentConn(conn net.Conn, in *inbound, originalDst func(net.Conn) (string, error)) {
+	target, err := originalDst(conn)
+	if err == nil && target == conn.LocalAddr().String() {
+		err = errTransparentLoop
+	}
+	if err != nil {
+		log.Printf("Transparent connection from %s dropped: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	remote, err := in.dial(target)
+	if err != nil {
+		log.Printf("Transparent %s -> %s failed: %v", conn.RemoteAddr(), target, err)
+		conn.Close()
+		return
+	}
+	log.Printf("Transparent %s -> %s", conn.RemoteAddr(), target)
+	relayConns(conn, remote)
+}
+
+// localAddrDst 用于 TPROXY：连接的本地地址就是原始目标地址
+func localAddrDst(conn net.Conn) (string, error) {
+	return conn.LocalAddr().String(), nil
+}
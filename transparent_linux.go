@@ -0,0 +1,428 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst 是 netfilter 的 SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// redirectOriginalDst 通过 SO_ORIGINAL_DST 取出被 iptables REDIRECT 之前的目标地址
+func redirectOriginalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	var serr error
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// 内核返回 sockaddr_in，借用 IPv6Mreq 的 16 字节缓冲区读取
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			target = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		// 内核返回 sockaddr_in6，借用 IPv6MTUInfo 读取
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		target = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, serr
+}
+
+// transparentControl 为 TPROXY 监听设置 IP_TRANSPARENT，UDP 还要求内核附带原始目标地址
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			serr = err
+			return
+		}
+		udp := network == "udp" || network == "udp4" || network == "udp6"
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+			serr = fmt.Errorf("set IP_TRANSPARENT: %v", err)
+			return
+		}
+		if udp {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+				serr = fmt.Errorf("set IP_RECVORIGDSTADDR: %v", err)
+				return
+			}
+		}
+		if domain != unix.AF_INET6 {
+			return
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			serr = fmt.Errorf("set IPV6_TRANSPARENT: %v", err)
+			return
+		}
+		if udp {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				serr = fmt.Errorf("set IPV6_RECVORIGDSTADDR: %v", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// listenTProxy 打开 TPROXY 使用的 TCP 和 UDP 监听，需要 CAP_NET_ADMIN
+func listenTProxy(addr string) (net.Listener, net.PacketConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return ln, pc, nil
+}
+
+// origDstFromOOB 从 IP_RECVORIGDSTADDR 附带的控制消息中取出原始目标地址
+func origDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// sockaddr_in: family(2) port(2) addr(4)
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// sockaddr_in6: family(2) port(2) flowinfo(4) addr(16)
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("original destination missing from control message")
+}
+
+// routingMarkControl 按 routing_mark 给代理自身发出的连接设置 SO_MARK，
+// 透明代理的 iptables 规则据此放行这些连接，避免它们又被转回代理
+func routingMarkControl(network, address string, c syscall.RawConn) error {
+	configMutex.RLock()
+	mark := config.RoutingMark
+	configMutex.RUnlock()
+	if mark == 0 {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("set SO_MARK %d: %w", mark, serr)
+	}
+	return nil
+}
+
+// serveTProxyUDP 读取 TPROXY 转来的 UDP 包，按（客户端, 原始目标）建立会话
+func serveTProxyUDP(pc net.PacketConn, in *inbound) {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	flows := newTProxyUDPFlows(func(client, dst *net.UDPAddr, onClose func()) (udpFlowSession, error) {
+		return newTProxyUDPSession(in, client, dst, onClose)
+	})
+	defer flows.stop()
+
+	b := make([]byte, udpBufferSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, from, err := conn.ReadMsgUDP(b, oob)
+		if err != nil {
+			return
+		}
+		dst, err := origDstFromOOB(oob[:oobn])
+		if err != nil {
+			log.Println("Dropping TPROXY UDP packet:", err)
+			continue
+		}
+		flows.dispatch(from, dst, b[:n])
+	}
+}
+
+// udpFlowSession 是一个已建立的 UDP 会话
+type udpFlowSession interface {
+	send(payload []byte) error
+	close()
+}
+
+// tproxyUDPFlowPending 限制会话建立期间缓存的包数，超出的直接丢弃
+const tproxyUDPFlowPending = 32
+
+// tproxyUDPFlows 把 UDP 包分发到各自的会话。新会话（路由、解析、远端握手可能很慢）
+// 在单独的协程中建立，期间到达的包先缓存，读取循环和其他会话不会被阻塞
+type tproxyUDPFlows struct {
+	create func(client, dst *net.UDPAddr, onClose func()) (udpFlowSession, error)
+
+	mu      sync.Mutex
+	flows   map[string]*tproxyUDPFlow
+	stopped bool
+}
+
+type tproxyUDPFlow struct {
+	session udpFlowSession // 为 nil 时还在建立
+	pending [][]byte
+}
+
+func newTProxyUDPFlows(create func(client, dst *net.UDPAddr, onClose func()) (udpFlowSession, error)) *tproxyUDPFlows {
+	return &tproxyUDPFlows{create: create, flows: make(map[string]*tproxyUDPFlow)}
+}
+
+// dispatch 把一个包交给对应的会话，packet 会被复制
+func (t *tproxyUDPFlows) dispatch(client, dst *net.UDPAddr, packet []byte) {
+	key := client.String() + "|" + dst.String()
+	t.mu.Lock()
+	f, ok := t.flows[key]
+	switch {
+	case t.stopped:
+		t.mu.Unlock()
+		return
+	case !ok:
+		f = &tproxyUDPFlow{pending: [][]byte{append([]byte(nil), packet...)}}
+		t.flows[key] = f
+		t.mu.Unlock()
+		go t.establish(key, f, client, dst)
+		return
+	case f.session == nil:
+		if len(f.pending) < tproxyUDPFlowPending {
+			f.pending = append(f.pending, append([]byte(nil), packet...))
+		}
+		t.mu.Unlock()
+		return
+	}
+	s := f.session
+	t.mu.Unlock()
+	if err := s.send(packet); err != nil {
+		log.Printf("TPROXY UDP %s -> %s: %v", client, dst, err)
+	}
+}
+
+// establish 建立会话并发出缓存的包；失败时移除该流，之后的包会重新尝试
+func (t *tproxyUDPFlows) establish(key string, f *tproxyUDPFlow, client, dst *net.UDPAddr) {
+	s, err := t.create(client, dst, func() {
+		t.mu.Lock()
+		if t.flows[key] == f {
+			delete(t.flows, key)
+		}
+		t.mu.Unlock()
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		delete(t.flows, key)
+		log.Printf("TPROXY UDP %s -> %s: %v", client, dst, err)
+		return
+	}
+	if t.stopped {
+		go s.close()
+		return
+	}
+	// 持有锁发送缓存的包，保证它们排在之后到达的包前面；UDP 写入不会阻塞
+	for _, p := range f.pending {
+		if err := s.send(p); err != nil {
+			log.Printf("TPROXY UDP %s -> %s: %v", client, dst, err)
+		}
+	}
+	f.session, f.pending = s, nil
+}
+
+// stop 关闭所有会话，之后建立完成的会话也会被关闭
+func (t *tproxyUDPFlows) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	var sessions []udpFlowSession
+	for _, f := range t.flows {
+		if f.session != nil {
+			sessions = append(sessions, f.session)
+		}
+	}
+	t.mu.Unlock()
+	// close 会回调 onClose 获取锁，必须在锁外调用
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+// tproxyUDPSession 是一个透明 UDP 会话。回程的包需要以原始目标地址为源地址发给客户端，
+// 所以为每个会话打开一个绑定在原始目标地址上的透明套接字
+type tproxyUDPSession struct {
+	client *net.UDPAddr
+	target string // 还原假 IP 之后的目标
+	back   *net.UDPConn
+	direct *net.UDPConn
+	up     *upstreamUDP
+
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newTProxyUDPSession(in *inbound, client, dst *net.UDPAddr, onClose func()) (*tproxyUDPSession, error) {
+	target := restoreFakeIP(dst.String())
+	action := in.route(target)
+	if action == ActionReject {
+		return nil, fmt.Errorf("connection to %s %w", target, errRejected)
+	}
+
+	network := "udp4"
+	if dst.IP.To4() == nil {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return serr
+		}
+		return transparentControl(network, address, c)
+	}}
+	backPC, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, fmt.Errorf("bind reply socket on %s: %v", dst, err)
+	}
+	s := &tproxyUDPSession{client: client, target: target, back: backPC.(*net.UDPConn), onClose: onClose}
+
+	if action == ActionDirect {
+		addr, err := resolveUDPAddr(target)
+		if err == nil {
+			var conn net.Conn
+			conn, err = outboundDialer(0).Dial("udp", addr.String())
+			if err == nil {
+				s.direct = conn.(*net.UDPConn)
+			}
+		}
+		if err != nil {
+			s.back.Close()
+			return nil, err
+		}
+		go s.readDirect()
+	} else {
+		u, err := getUpstream(action)
+		if err == nil && !u.isSOCKS5() {
+			err = fmt.Errorf("upstream %s (%s) does not support UDP", u.cfg.Name, u.cfg.Type)
+		}
+		if err == nil {
+			s.up, err = dialUpstreamUDP(u)
+		}
+		if err != nil {
+			s.back.Close()
+			return nil, err
+		}
+		go s.readUpstream()
+	}
+	log.Printf("TPROXY UDP %s -> %s via %s", client, target, action)
+	return s, nil
+}
+
+// send 发出客户端的包，并推迟会话的空闲超时，只有发送没有回包的会话不会被提前关闭
+func (s *tproxyUDPSession) send(payload []byte) error {
+	deadline := time.Now().Add(tproxyUDPIdleTimeout)
+	if s.direct != nil {
+		s.direct.SetReadDeadline(deadline)
+		_, err := s.direct.Write(payload)
+		return err
+	}
+	s.up.conn.SetReadDeadline(deadline)
+	host, port, _ := net.SplitHostPort(s.target)
+	portNum, _ := strconv.Atoi(port)
+	_, err := s.up.conn.Write(append(appendSocks5Addr([]byte{0, 0, 0}, host, portNum), payload...))
+	return err
+}
+
+func (s *tproxyUDPSession) readDirect() {
+	defer s.close()
+	b := make([]byte, udpBufferSize)
+	for {
+		s.direct.SetReadDeadline(time.Now().Add(tproxyUDPIdleTimeout))
+		n, err := s.direct.Read(b)
+		if err != nil {
+			return
+		}
+		s.back.WriteToUDP(b[:n], s.client)
+	}
+}
+
+func (s *tproxyUDPSession) readUpstream() {
+	defer s.close()
+	b := make([]byte, udpBufferSize)
+	for {
+		s.up.conn.SetReadDeadline(time.Now().Add(tproxyUDPIdleTimeout))
+		n, err := s.up.conn.Read(b)
+		if err != nil {
+			return
+		}
+		// 去掉远端中继加的 SOCKS5 头
+		_, payload, err := parseSocks5UDPPacket(b[:n])
+		if err != nil {
+			continue
+		}
+		s.back.WriteToUDP(payload, s.client)
+	}
+}
+
+func (s *tproxyUDPSession) close() {
+	s.closeOnce.Do(func() {
+		s.back.Close()
+		if s.direct != nil {
+			s.direct.Close()
+		}
+		if s.up != nil {
+			s.up.close()
+		}
+		s.onClose()
+	})
+}
@@ -0,0 +1,295 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// origDstCmsg 构造一条内核格式的 ORIGDSTADDR 控制消息
+func origDstCmsg(level, typ int32, sockaddr []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(sockaddr)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = level, typ
+	h.SetLen(unix.CmsgLen(len(sockaddr)))
+	copy(b[unix.CmsgLen(0):], sockaddr)
+	return b
+}
+
+func TestOrigDstFromOOB(t *testing.T) {
+	in4 := make([]byte, unix.SizeofSockaddrInet4)
+	binary.LittleEndian.PutUint16(in4[0:2], unix.AF_INET)
+	binary.BigEndian.PutUint16(in4[2:4], 53)
+	copy(in4[4:8], net.IPv4(198, 18, 0, 7).To4())
+
+	in6 := make([]byte, unix.SizeofSockaddrInet6)
+	binary.LittleEndian.PutUint16(in6[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(in6[2:4], 443)
+	copy(in6[8:24], net.ParseIP("2001:db8::1"))
+
+	// 其他控制消息排在前面时也要找到原始目标
+	other := origDstCmsg(unix.SOL_SOCKET, unix.SO_TIMESTAMP, make([]byte, 16))
+	tests := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{"ipv4", origDstCmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, in4), "198.18.0.7:53"},
+		{"ipv6", origDstCmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, in6), "[2001:db8::1]:443"},
+		{"after other", append(other, origDstCmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, in4)...), "198.18.0.7:53"},
+	}
+	for _, tt := range tests {
+		got, err := origDstFromOOB(tt.oob)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%s: origDstFromOOB = %v, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := origDstFromOOB(other); err == nil {
+		t.Error("missing ORIGDSTADDR accepted")
+	}
+	if _, err := origDstFromOOB(origDstCmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, in4[:4])); err == nil {
+		t.Error("truncated sockaddr_in accepted")
+	}
+}
+
+// fakeFlowSession 记录发给会话的包
+type fakeFlowSession struct {
+	mu      sync.Mutex
+	packets []string
+	sent    chan struct{}
+	onClose func()
+}
+
+func (s *fakeFlowSession) send(p []byte) error {
+	s.mu.Lock()
+	s.packets = append(s.packets, string(p))
+	s.mu.Unlock()
+	s.sent <- struct{}{}
+	return nil
+}
+
+func (s *fakeFlowSession) close() { s.onClose() }
+
+func (s *fakeFlowSession) got() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.packets...)
+}
+
+func TestTProxyUDPFlowsSlowSessionDoesNotBlock(t *testing.T) {
+	slow := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 53}
+	fast := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 2), Port: 53}
+	bad := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 3), Port: 53}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	sessions := make(map[string]*fakeFlowSession)
+	attempts := 0
+	flows := newTProxyUDPFlows(func(c, dst *net.UDPAddr, onClose func()) (udpFlowSession, error) {
+		switch dst.String() {
+		case slow.String():
+			<-release // 模拟很慢的远端握手
+		case bad.String():
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			return nil, errors.New("dial failed")
+		}
+		s := &fakeFlowSession{sent: make(chan struct{}, 64), onClose: onClose}
+		mu.Lock()
+		sessions[dst.String()] = s
+		mu.Unlock()
+		return s, nil
+	})
+	session := func(dst *net.UDPAddr) *fakeFlowSession {
+		mu.Lock()
+		defer mu.Unlock()
+		return sessions[dst.String()]
+	}
+	wait := func(s *fakeFlowSession, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-s.sent:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for packet %d", i+1)
+			}
+		}
+	}
+
+	buf := []byte("slow-1")
+	flows.dispatch(client, slow, buf)
+	copy(buf, "XXXXXX") // dispatch 必须复制包，读取缓冲区会被复用
+	flows.dispatch(client, slow, []byte("slow-2"))
+
+	// 慢会话还在建立时，其他目标的包照常送达
+	done := make(chan struct{})
+	go func() {
+		flows.dispatch(client, fast, []byte("fast-1"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dispatch blocked by a session being established")
+	}
+	for session(fast) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	wait(session(fast), 1)
+
+	// 建立完成后缓存的包按顺序发出，之后的包直接发送
+	close(release)
+	for session(slow) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	wait(session(slow), 2)
+	flows.dispatch(client, slow, []byte("slow-3"))
+	wait(session(slow), 1)
+	if got := session(slow).got(); len(got) != 3 || got[0] != "slow-1" || got[1] != "slow-2" || got[2] != "slow-3" {
+		t.Errorf("slow session packets = %q", got)
+	}
+
+	// 建立失败的流被移除，下一个包重新尝试
+	flows.dispatch(client, bad, []byte("x"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		flows.mu.Lock()
+		_, pending := flows.flows[client.String()+"|"+bad.String()]
+		flows.mu.Unlock()
+		if !pending || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	flows.dispatch(client, bad, []byte("y"))
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := attempts
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	if attempts != 2 {
+		t.Errorf("failed flow attempted %d times, want 2", attempts)
+	}
+	mu.Unlock()
+
+	// stop 关闭所有会话，会话从表中移除
+	flows.stop()
+	flows.mu.Lock()
+	left := len(flows.flows)
+	flows.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d flows left after stop", left)
+	}
+}
+
+func TestTProxyUDPSendExtendsIdleDeadline(t *testing.T) {
+	// 目标在 300ms 后才回包
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		b := make([]byte, 64)
+		n, from, err := target.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		time.Sleep(300 * time.Millisecond)
+		target.WriteToUDP(b[:n], from)
+	}()
+
+	conn, err := net.DialUDP("udp", nil, target.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := &tproxyUDPSession{direct: conn}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := s.send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("read after send: %q, %v (send did not extend the idle deadline)", b[:n], err)
+	}
+}
+
+func TestRoutingMarkOnDirectDials(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	mark := func(conn net.Conn) int {
+		t.Helper()
+		raw, err := conn.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		var serr error
+		raw.Control(func(fd uintptr) {
+			v, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+		})
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		return v
+	}
+
+	conn, err := dialDirect(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mark(conn); got != 0 {
+		t.Errorf("mark without routing_mark = %d, want 0", got)
+	}
+	conn.Close()
+
+	setRoutingMark := func(mark int) {
+		configMutex.Lock()
+		config.RoutingMark = mark
+		configMutex.Unlock()
+	}
+	setRoutingMark(0xff)
+	defer setRoutingMark(0)
+	conn, err = dialDirect(ln.Addr().String())
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := mark(conn); got != 0xff {
+		t.Errorf("mark = %#x, want 0xff", got)
+	}
+}
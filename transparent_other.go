@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// errTransparentUnsupported 表示当前系统不支持透明代理入口
+var errTransparentUnsupported = errors.New("transparent proxy inbounds are only supported on Linux")
+
+func redirectOriginalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
+
+func listenTProxy(addr string) (net.Listener, net.PacketConn, error) {
+	return nil, nil, errTransparentUnsupported
+}
+
+func serveTProxyUDP(pc net.PacketConn, in *inbound) {}
+
+// routingMarkControl 在其他系统上不做任何事，routing_mark 只在 Linux 上生效
+func routingMarkControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestTransparent 启动一个透明入口，原始目标地址由 dst 给出（代替 SO_ORIGINAL_DST）
+func startTestTransparent(t *testing.T, dst func(net.Conn) (string, error)) string {
+	t.Helper()
+	config.Rules = []string{"MATCH,DIRECT"}
+	InitRules()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		config.Rules = nil
+		InitRules()
+	})
+	go serveTransparent(ln, nil, dst)
+	return ln.Addr().String()
+}
+
+func TestTransparentRelaysToOriginalDestination(t *testing.T) {
+	origin := newOriginServer(t)
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+	addr := startTestTransparent(t, func(net.Conn) (string, error) { return originAddr, nil })
+
+	// 客户端以为自己直接连的是目标，发送普通的 HTTP 请求
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+originAddr+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from origin" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestTransparentRefusesLoop(t *testing.T) {
+	// 没有经过 REDIRECT 的连接，原始目标就是监听地址本身
+	addr := startTestTransparent(t, localAddrDst)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the looping connection to be closed", err)
+	}
+}
@@ -51,6 +51,9 @@ const (
 	StatusStarting      ProxyStatus = "starting"
 	StatusRunningHTTP   ProxyStatus = "running_http"
 	StatusRunningSocks5 ProxyStatus = "running_socks5"
+	StatusRunningMixed  ProxyStatus = "running_mixed"
+	StatusRunningMulti  ProxyStatus = "running_multi"
+	StatusRunningDNS    ProxyStatus = "running_dns"
 	StatusRestarting    ProxyStatus = "restarting"
 	StatusError         ProxyStatus = "error"
 )
@@ -207,6 +210,18 @@ func UpdateTray(status ProxyStatus) {
 			s.Tooltip = "运行中（SOCKS5 模式）"
 			s.Title = "状态: 运行中（SOCKS5）"
 			s.Status = true
+		case StatusRunningMixed:
+			s.Tooltip = "运行中（HTTP+SOCKS 混合模式）"
+			s.Title = "状态: 运行中（Mixed）"
+			s.Status = true
+		case StatusRunningMulti:
+			s.Tooltip = "运行中（多个监听入口）"
+			s.Title = "状态: 运行中（多入口）"
+			s.Status = true
+		case StatusRunningDNS:
+			s.Tooltip = "运行中（DNS 服务）"
+			s.Title = "状态: 运行中（DNS）"
+			s.Status = true
 		case StatusRestarting:
 			s.Tooltip = "正在重启代理服务..."
 			s.Title = "状态: 正在重启中..."
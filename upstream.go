@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamConfig 定义一个具名的远端代理
+type UpstreamConfig struct {
+	Name   string `yaml:"name" json:"name"`
+	Type   string `yaml:"type" json:"type"` // socks5 或 http
+	Server string `yaml:"server" json:"server"`
+	Port   int    `yaml:"port" json:"port"`
+
+	// 远端代理认证，SOCKS5 使用用户名/密码认证，HTTP 使用 Proxy-Authorization
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+}
+
+func (u UpstreamConfig) addr() string {
+	return fmt.Sprintf("%s:%d", u.Server, u.Port)
+}
+
+// upstream 是注册表中一个预先构建好的远端代理
+type upstream struct {
+	cfg    UpstreamConfig
+	dialer proxy.Dialer
+}
+
+func (u *upstream) isHTTP() bool {
+	return strings.ToLower(u.cfg.Type) == "http"
+}
+
+func (u *upstream) isSOCKS5() bool {
+	return strings.ToLower(u.cfg.Type) == "socks5"
+}
+
+// proxyURL 返回 HTTP 远端代理的地址，带上认证信息
+func (u *upstream) proxyURL() *url.URL {
+	pu := &url.URL{Scheme: "http", Host: u.cfg.addr()}
+	if u.cfg.Username != "" {
+		pu.User = url.UserPassword(u.cfg.Username, u.cfg.Password)
+	}
+	return pu
+}
+
+var (
+	upstreams       map[string]*upstream
+	defaultUpstream string
+	upstreamMutex   sync.RWMutex
+)
+
+// upstreamConfigs 返回配置中的远端代理列表，未配置 proxies 时使用旧的 default_target
+func upstreamConfigs(cfg Config) []UpstreamConfig {
+	if len(cfg.Proxies) > 0 {
+		return cfg.Proxies
+	}
+	if cfg.DefaultTarget.IP == "" {
+		return nil
+	}
+	return []UpstreamConfig{{
+		Name:   "default",
+		Type:   cfg.RemoteMode,
+		Server: cfg.DefaultTarget.IP,
+		Port:   cfg.DefaultTarget.Port,
+
+		Username: cfg.DefaultTarget.Username,
+		Password: cfg.DefaultTarget.Password,
+	}}
+}
+
+// isUpstreamName 判断名称是否为 InitUpstreams 注册成功的远端代理，被跳过的无效配置不算
+func isUpstreamName(name string) bool {
+	upstreamMutex.RLock()
+	defer upstreamMutex.RUnlock()
+	_, ok := upstreams[name]
+	return ok
+}
+
+// InitUpstreams 根据配置预先构建所有远端代理的 dialer，第一个代理作为默认代理
+func InitUpstreams() {
+	registry := make(map[string]*upstream)
+	first := ""
+	for _, u := range upstreamConfigs(config) {
+		if u.Name == "" {
+			log.Printf("Skipping upstream %s without a name", u.addr())
+			continue
+		}
+		switch strings.ToUpper(u.Name) {
+		case ActionDirect, ActionProxy, ActionReject:
+			log.Printf("Skipping upstream with reserved name %s", u.Name)
+			continue
+		}
+		if _, dup := registry[u.Name]; dup {
+			log.Printf("Skipping duplicate upstream %s", u.Name)
+			continue
+		}
+		d, err := newUpstreamDialer(u)
+		if err != nil {
+			log.Printf("Skipping upstream %s: %v", u.Name, err)
+			continue
+		}
+		registry[u.Name] = &upstream{cfg: u, dialer: d}
+		if first == "" {
+			first = u.Name
+		}
+	}
+
+	upstreamMutex.Lock()
+	upstreams = registry
+	defaultUpstream = first
+	upstreamMutex.Unlock()
+	log.Printf("✔ Loaded %d upstream proxies (default: %s)", len(registry), first)
+	resetHTTPTransports()
+}
+
+// newUpstreamDialer 根据远端代理类型生成 dialer
+func newUpstreamDialer(u UpstreamConfig) (proxy.Dialer, error) {
+	switch strings.ToLower(u.Type) {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.Username != "" {
+			auth = &proxy.Auth{User: u.Username, Password: u.Password}
+		}
+		return proxy.SOCKS5("tcp", u.addr(), auth, outboundDialer(0))
+	case "http":
+		return &httpConnectDialer{addr: u.addr(), username: u.Username, password: u.Password, forward: outboundDialer(0)}, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream type: %s", u.Type)
+}
+
+// getUpstream 按名称取出远端代理，名称为空或 PROXY 时返回默认代理
+func getUpstream(name string) (*upstream, error) {
+	upstreamMutex.RLock()
+	defer upstreamMutex.RUnlock()
+	if name == "" || name == ActionProxy {
+		name = defaultUpstream
+	}
+	if u, ok := upstreams[name]; ok {
+		return u, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no upstream proxy configured")
+	}
+	return nil, fmt.Errorf("unknown upstream proxy: %s", name)
+}
+
+// getUpstreamDialer 按名称取出预先构建的 dialer
+func getUpstreamDialer(name string) (proxy.Dialer, error) {
+	u, err := getUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	return u.dialer, nil
+}
+
+// getChainDialer 返回默认的远端代理 dialer
+func getChainDialer() (proxy.Dialer, error) {
+	return getUpstreamDialer("")
+}
@@ -65,7 +65,12 @@ func EnableBypassList() {
 }
 
 func configureWinHTTPProxy() {
-	proxyAddr := fmt.Sprintf("127.0.0.1:%d", config.ListenPort)
+	port, ok := systemProxyPort()
+	if !ok {
+		log.Println("没有 HTTP 入口，跳过设置 WinHTTP 代理")
+		return
+	}
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", port)
 	cmd := exec.Command("netsh", "winhttp", "set", "proxy", proxyAddr)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
@@ -89,7 +94,12 @@ func resetWinHTTPProxy() {
 }
 
 func configureSystemProxy() {
-	proxyAddr := fmt.Sprintf("127.0.0.1:%d", config.ListenPort)
+	port, ok := systemProxyPort()
+	if !ok {
+		log.Println("没有 HTTP 入口，跳过设置系统代理")
+		return
+	}
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", port)
 
 	key, _, err := registry.CreateKey(
 		registry.CURRENT_USER,
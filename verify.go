@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// VerifyConfig 是远程数据源的下载校验，校验失败时保留上一次的缓存
+type VerifyConfig struct {
+	MinEntries int    `yaml:"min_entries,omitempty" json:"min_entries,omitempty"` // 有效条目（IP 列表为有效行数，域名列表为域名数）少于此数时拒绝，默认 1
+	SHA256     string `yaml:"sha256,omitempty" json:"sha256,omitempty"`           // sha256sum 格式的校验文件地址
+	PublicKey  string `yaml:"public_key,omitempty" json:"public_key,omitempty"`   // minisign 公钥（RW 开头）或 base64 编码的 ed25519 公钥
+	Signature  string `yaml:"signature,omitempty" json:"signature,omitempty"`     // 签名文件地址，默认为下载地址加 .minisig 或 .sig
+}
+
+// sidecarSizeLimit 限制校验文件和签名文件的大小
+const sidecarSizeLimit = 64 << 10
+
+// sourceValidator 校验从 url 下载的内容并返回条目数，通过后才会写入缓存；校验文件和签名用同一个 client 下载
+type sourceValidator func(body []byte, url string, client *http.Client) (int, error)
+
+// newSourceValidator 依次检查校验和、签名和条目数，count 用数据源自己的解析器统计条目
+func newSourceValidator(v VerifyConfig, count func(body []byte) (int, error)) sourceValidator {
+	return func(body []byte, url string, client *http.Client) (int, error) {
+		if v.SHA256 != "" {
+			if err := verifySHA256(client, body, v.SHA256); err != nil {
+				return 0, err
+			}
+		}
+		if v.PublicKey != "" {
+			if err := verifySignature(client, body, url, v.PublicKey, v.Signature); err != nil {
+				return 0, err
+			}
+		}
+		n, err := count(body)
+		if err != nil {
+			return 0, fmt.Errorf("downloaded content is invalid: %v", err)
+		}
+		if min := max(v.MinEntries, 1); n < min {
+			return 0, fmt.Errorf("downloaded content has %d entries, want at least %d", n, min)
+		}
+		return n, nil
+	}
+}
+
+// fetchSidecar 下载校验文件或签名文件
+func fetchSidecar(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: unexpected status %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, sidecarSizeLimit))
+}
+
+// verifySHA256 对比 sha256sum 格式（"<hex>  <文件名>"）校验文件的第一项
+func verifySHA256(client *http.Client, body []byte, url string) error {
+	sum, err := fetchSidecar(client, url)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file %s", url)
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid checksum in %s", url)
+	}
+	if got := sha256.Sum256(body); !bytes.Equal(got[:], want) {
+		return fmt.Errorf("SHA-256 mismatch: got %x, want %x", got, want)
+	}
+	return nil
+}
+
+// lastBase64Line 返回去掉 "untrusted comment:" 之后的第一行内容，兼容直接粘贴的 minisign 公钥文件
+func lastBase64Line(s string) string {
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			return line
+		}
+	}
+	return ""
+}
+
+// verifySignature 校验 minisign 或原始 ed25519 签名，未指定签名地址时使用下载地址加后缀
+func verifySignature(client *http.Client, body []byte, source, publicKey, sigURL string) error {
+	key, err := base64.StdEncoding.DecodeString(lastBase64Line(publicKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	switch {
+	case len(key) == 42 && string(key[:2]) == "Ed":
+		if sigURL == "" {
+			sigURL = source + ".minisig"
+		}
+		sig, err := fetchSidecar(client, sigURL)
+		if err != nil {
+			return err
+		}
+		return verifyMinisign(body, key, sig)
+	case len(key) == ed25519.PublicKeySize:
+		if sigURL == "" {
+			sigURL = source + ".sig"
+		}
+		sig, err := fetchSidecar(client, sigURL)
+		if err != nil {
+			return err
+		}
+		// 签名文件可以是 64 字节原始签名或它的 base64
+		if len(sig) != ed25519.SignatureSize {
+			if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+				return fmt.Errorf("invalid signature file: %v", err)
+			}
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), body, sig) {
+			return fmt.Errorf("ed25519 signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key format")
+}
+
+// verifyMinisign 校验 minisign 签名文件：
+//
+//	untrusted comment: ...
+//	base64(算法 "Ed"/"ED" || key id || 签名)
+//	trusted comment: ...
+//	base64(对 签名 || 可信注释 的全局签名)
+//
+// "ED" 表示对内容的 BLAKE2b-512 摘要签名
+func verifyMinisign(body, key, sigFile []byte) error {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(sigFile))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign global signature")
+	}
+	if !bytes.Equal(sig[2:10], key[2:10]) {
+		return fmt.Errorf("minisign key id mismatch")
+	}
+
+	pub := ed25519.PublicKey(key[10:])
+	msg := body
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(body)
+		msg = sum[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pub, msg, sig[10:]) {
+		return fmt.Errorf("minisign signature verification failed")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(pub, append(append([]byte(nil), sig[10:]...), trusted...), globalSig) {
+		return fmt.Errorf("minisign trusted comment verification failed")
+	}
+	return nil
+}
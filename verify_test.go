@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// startStandInFileServer 按路径返回 files 中的内容，测试中可以修改 files
+func startStandInFileServer(t *testing.T, files map[string][]byte) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// testMinisign 用给定的算法（"Ed" 或 "ED"）生成 minisign 公钥和签名文件
+func testMinisign(t *testing.T, body []byte, alg string) (string, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	msg := body
+	if alg == "ED" {
+		sum := blake2b.Sum512(body)
+		msg = sum[:]
+	}
+	sig := append(append([]byte(alg), keyID...), ed25519.Sign(priv, msg)...)
+	trusted := "timestamp:1700000000\tfile:cn.txt"
+	global := ed25519.Sign(priv, append(append([]byte(nil), sig[10:]...), trusted...))
+
+	publicKey := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+	sigFile := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+	return publicKey, []byte(sigFile)
+}
+
+func TestSourceValidatorRejectsBadContent(t *testing.T) {
+	validate := newSourceValidator(VerifyConfig{MinEntries: 2}, countIPSetEntries)
+	cases := map[string]bool{
+		"<html><body>502 Bad Gateway</body></html>": false,
+		"":                       false,
+		"1.0.0.0/8\n":            false, // 少于 min_entries
+		"1.0.0.0/8\n3.0.0.0/8\n": true,
+		"1.0.0.0/8\n2.0.0.0/8\n": true,  // 按行计数，相邻网段不合并
+		"1.0.0.0/8\nbogus\n":     false, // 无效行不计数
+	}
+	for body, ok := range cases {
+		n, err := validate([]byte(body), "http://example/cn.txt", http.DefaultClient)
+		if (err == nil) != ok {
+			t.Errorf("validate(%q) = %v, want ok=%v", body, err, ok)
+		}
+		if ok && n != 2 {
+			t.Errorf("validate(%q) counted %d entries, want 2", body, n)
+		}
+	}
+}
+
+func TestSourceValidatorChecksumAndSignatures(t *testing.T) {
+	body := []byte("1.0.0.0/8\n")
+	sum := sha256.Sum256(body)
+	files := map[string][]byte{
+		"/cn.txt.sha256sum": []byte(hex.EncodeToString(sum[:]) + "  cn.txt\n"),
+		"/bad.sha256sum":    []byte(strings.Repeat("0", 64) + "\n"),
+	}
+	url := startStandInFileServer(t, files)
+	source := url + "/cn.txt"
+
+	check := func(name string, v VerifyConfig, body []byte, ok bool) {
+		t.Helper()
+		_, err := newSourceValidator(v, countIPSetEntries)(body, source, http.DefaultClient)
+		if (err == nil) != ok {
+			t.Errorf("%s: err = %v, want ok=%v", name, err, ok)
+		}
+	}
+	check("sha256", VerifyConfig{SHA256: url + "/cn.txt.sha256sum"}, body, true)
+	check("sha256 mismatch", VerifyConfig{SHA256: url + "/bad.sha256sum"}, body, false)
+	check("sha256 missing", VerifyConfig{SHA256: url + "/missing"}, body, false)
+
+	for _, alg := range []string{"Ed", "ED"} {
+		key, sig := testMinisign(t, body, alg)
+		files["/cn.txt.minisig"] = sig
+		check("minisign "+alg, VerifyConfig{PublicKey: key}, body, true)
+		check("minisign "+alg+" tampered", VerifyConfig{PublicKey: key}, []byte("2.0.0.0/8\n"), false)
+
+		otherKey, _ := testMinisign(t, body, alg)
+		check("minisign "+alg+" wrong key", VerifyConfig{PublicKey: otherKey}, body, false)
+
+		files["/cn.txt.minisig"] = []byte(strings.Replace(string(sig), "timestamp:", "timestamp:9", 1))
+		check("minisign "+alg+" trusted comment", VerifyConfig{PublicKey: key}, body, false)
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	files["/cn.txt.sig"] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, body)))
+	files["/raw.sig"] = ed25519.Sign(priv, body)
+	rawKey := base64.StdEncoding.EncodeToString(pub)
+	check("ed25519", VerifyConfig{PublicKey: rawKey}, body, true)
+	check("ed25519 raw signature file", VerifyConfig{PublicKey: rawKey, Signature: url + "/raw.sig"}, body, true)
+	check("ed25519 tampered", VerifyConfig{PublicKey: rawKey}, []byte("2.0.0.0/8\n"), false)
+}
+
+func TestFetchCachedKeepsGoodCacheOnRejectedDownload(t *testing.T) {
+	useTestCacheDir(t)
+	files := map[string][]byte{"/cn.txt": []byte("1.0.0.0/8\n")}
+	url := startStandInFileServer(t, files)
+	validate := newSourceValidator(VerifyConfig{}, countIPSetEntries)
+
+	if _, err := fetchCached(url+"/cn.txt", defaultCacheMaxAge, FetchConfig{}, validate); err != nil {
+		t.Fatal(err)
+	}
+	expireCache(t, cachePath(url+"/cn.txt"))
+
+	// 上游返回错误页面：拒绝并回退到旧缓存
+	files["/cn.txt"] = []byte("<html>captive portal</html>")
+	path, err := fetchCached(url+"/cn.txt", defaultCacheMaxAge, FetchConfig{}, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "1.0.0.0/8\n" {
+		t.Fatalf("cache overwritten with %q", data)
+	}
+
+	// 没有旧缓存时直接失败，错误中带上失败原因
+	files["/new.txt"] = files["/cn.txt"]
+	if _, err := fetchCached(url+"/new.txt", defaultCacheMaxAge, FetchConfig{}, validate); err == nil {
+		t.Fatal("invalid download accepted without a cache")
+	} else if !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("error %q does not include the cause", err)
+	}
+}